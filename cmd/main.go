@@ -1,6 +1,8 @@
 package main
 
 import (
+	"time"
+
 	maddrproxy "github.com/hrntknr/maddr-proxy/pkg/maddr-proxy"
 	"github.com/spf13/cobra"
 )
@@ -9,34 +11,148 @@ var flagWatch bool
 var flagIface []string
 var flagGw []string
 var flagUseHostMinAsGw bool
+var flagLocalPrefix []string
+var flagFwmark []string
+var flagNoSourceRules bool
 var setupRouteCmd = &cobra.Command{
 	Use: "setup-route",
 	Run: func(cmd *cobra.Command, args []string) {
-		if err := maddrproxy.SetupRoute(flagWatch, flagIface, flagGw, flagUseHostMinAsGw); err != nil {
+		if err := maddrproxy.SetupRoute(flagWatch, maddrproxy.RouteConfig{
+			Iface:          flagIface,
+			Gw:             flagGw,
+			UseHostMinAsGw: flagUseHostMinAsGw,
+			LocalPrefix:    flagLocalPrefix,
+			Fwmark:         flagFwmark,
+			NoSourceRules:  flagNoSourceRules,
+		}); err != nil {
 			panic(err)
 		}
 	},
 }
 
 var flagListen string
+var flagSocksListen string
+var flagSocksUDPTimeout time.Duration
+var flagBindDevice bool
+var flagSelectorHeader string
+var flagFailover int
+var flagEgressDNS bool
+var flagNameserver []string
+var flagDNSCacheSize int
+var flagHealthTarget []string
+var flagHealthInterval time.Duration
+var flagHealthRise int
+var flagHealthFall int
+var flagAdminListen string
+var flagTLSCert string
+var flagTLSKey string
+var flagTLSClientCA string
+var flagTLSClientPolicy []string
+var flagPoolMaxIdle int
+var flagPoolMaxIdlePerHost int
+var flagPoolMaxConnsPerHost int
+var flagPoolIdleTimeout time.Duration
 var flagPassword []string
+var flagHtpasswd string
+var flagUserACL []string
+var flagDestRule []string
+var flagDestNoDefault bool
+var flagPoolStrategy string
+var flagSessionTTL time.Duration
 var flagSetupRoute bool
 var flagSetupRouteIface []string
 var flagSetupRouteGw []string
 var flagSetupRouteUseHostMinAsGw bool
+var flagSetupRouteLocalPrefix []string
+var flagSetupRouteFwmark []string
+var flagSetupRouteNoSourceRules bool
+var flagMark []string
 var proxyCmd = &cobra.Command{
 	Use: "proxy",
 	Run: func(cmd *cobra.Command, args []string) {
 		if flagSetupRoute {
 			go func() {
-				if err := maddrproxy.SetupRoute(true, flagSetupRouteIface, flagSetupRouteGw, flagSetupRouteUseHostMinAsGw); err != nil {
+				if err := maddrproxy.SetupRoute(true, maddrproxy.RouteConfig{
+					Iface:          flagSetupRouteIface,
+					Gw:             flagSetupRouteGw,
+					UseHostMinAsGw: flagSetupRouteUseHostMinAsGw,
+					LocalPrefix:    flagSetupRouteLocalPrefix,
+					Fwmark:         flagSetupRouteFwmark,
+					NoSourceRules:  flagSetupRouteNoSourceRules,
+				}); err != nil {
+					panic(err)
+				}
+			}()
+		}
+		proxy := maddrproxy.NewProxy(flagPassword)
+		proxy.SetUDPTimeout(flagSocksUDPTimeout)
+		proxy.SetBindDevice(flagBindDevice)
+		proxy.SetSelectorHeader(flagSelectorHeader)
+		proxy.SetFailover(flagFailover)
+		proxy.SetDNSCache(flagDNSCacheSize)
+		if err := proxy.SetEgressDNS(flagEgressDNS, flagNameserver); err != nil {
+			panic(err)
+		}
+		if err := proxy.SetMarks(flagMark); err != nil {
+			panic(err)
+		}
+		if flagHtpasswd != "" {
+			if err := proxy.SetCredentialFile(flagHtpasswd); err != nil {
+				panic(err)
+			}
+		}
+		proxy.SetPool(flagPoolMaxIdle, flagPoolMaxIdlePerHost, flagPoolMaxConnsPerHost, flagPoolIdleTimeout)
+		if err := proxy.SetPoolStrategy(flagPoolStrategy); err != nil {
+			panic(err)
+		}
+		proxy.SetSessionTTL(flagSessionTTL)
+		if err := proxy.SetDestinationRules(flagDestRule, !flagDestNoDefault); err != nil {
+			panic(err)
+		}
+		if err := proxy.SetUserPolicies(flagUserACL); err != nil {
+			panic(err)
+		}
+		if flagTLSClientCA != "" {
+			if err := proxy.SetClientCA(flagTLSClientCA, flagTLSClientPolicy); err != nil {
+				panic(err)
+			}
+		}
+		if flagAdminListen != "" {
+			go func() {
+				if err := proxy.ListenAndServeAdmin(flagAdminListen); err != nil {
 					panic(err)
 				}
 			}()
 		}
-		if err := maddrproxy.NewProxy(flagPassword).ListenAndServe(flagListen); err != nil {
+		go func() {
+			if err := proxy.RunAddrInventory(); err != nil {
+				panic(err)
+			}
+		}()
+		if err := proxy.SetHealthCheck(flagHealthTarget, flagHealthInterval, flagHealthRise, flagHealthFall); err != nil {
 			panic(err)
 		}
+		go func() {
+			if err := proxy.RunHealthCheck(); err != nil {
+				panic(err)
+			}
+		}()
+		if flagSocksListen != "" {
+			go func() {
+				if err := proxy.ListenAndServeSocks(flagSocksListen); err != nil {
+					panic(err)
+				}
+			}()
+		}
+		if flagTLSCert != "" || flagTLSKey != "" {
+			if err := proxy.ListenAndServeTLS(flagListen, flagTLSCert, flagTLSKey); err != nil {
+				panic(err)
+			}
+		} else {
+			if err := proxy.ListenAndServe(flagListen); err != nil {
+				panic(err)
+			}
+		}
 	},
 }
 
@@ -48,13 +164,47 @@ func main() {
 	setupRouteCmd.Flags().StringSliceVarP(&flagIface, "iface", "i", []string{"en.*", "eth.*"}, "interface")
 	setupRouteCmd.Flags().StringSliceVarP(&flagGw, "gw", "g", []string{}, "gateway")
 	setupRouteCmd.Flags().BoolVarP(&flagUseHostMinAsGw, "use-host-min-as-gw", "", true, "use host min as gateway")
+	setupRouteCmd.Flags().StringSliceVarP(&flagLocalPrefix, "local-prefix", "", []string{}, "prefix to install as a local route for the prefix: selector")
+	setupRouteCmd.Flags().StringSliceVarP(&flagFwmark, "fwmark", "", []string{}, "fwmark rule to install (mark=iface)")
+	setupRouteCmd.Flags().BoolVarP(&flagNoSourceRules, "no-source-rules", "", false, "install only fwmark rules, not per-address rules")
 	rootCmd.AddCommand(setupRouteCmd)
 	proxyCmd.Flags().StringVarP(&flagListen, "listen", "l", ":1080", "listen address")
+	proxyCmd.Flags().StringVarP(&flagSocksListen, "socks-listen", "", "", "socks5 listen address")
+	proxyCmd.Flags().DurationVarP(&flagSocksUDPTimeout, "socks-udp-timeout", "", 2*time.Minute, "socks5 udp association idle timeout")
+	proxyCmd.Flags().StringArrayVarP(&flagHealthTarget, "health-target", "", []string{}, "health check target probed from every address (tcp://host:port or http(s)://...)")
+	proxyCmd.Flags().DurationVarP(&flagHealthInterval, "health-interval", "", 30*time.Second, "health check interval")
+	proxyCmd.Flags().IntVarP(&flagHealthRise, "health-rise", "", 2, "consecutive successful checks to mark an address up")
+	proxyCmd.Flags().IntVarP(&flagHealthFall, "health-fall", "", 3, "consecutive failed checks to mark an address down")
+	proxyCmd.Flags().BoolVarP(&flagEgressDNS, "egress-dns", "", false, "send dns queries from the selected source address")
+	proxyCmd.Flags().IntVarP(&flagDNSCacheSize, "dns-cache-size", "", 10000, "maximum number of cached dns lookups (0 to disable)")
+	proxyCmd.Flags().StringArrayVarP(&flagNameserver, "nameserver", "", []string{}, "nameservers per interface, queried from that interface (iface=addr,...; * for others)")
+	proxyCmd.Flags().IntVarP(&flagFailover, "failover", "", 0, "retry a failed dial from up to this many other addresses of the same pool or interface")
+	proxyCmd.Flags().BoolVarP(&flagBindDevice, "bind-device", "", false, "bind outbound sockets to the selected interface (SO_BINDTODEVICE)")
+	proxyCmd.Flags().StringVarP(&flagTLSCert, "tls-cert", "", "", "tls certificate file")
+	proxyCmd.Flags().StringVarP(&flagTLSKey, "tls-key", "", "", "tls key file")
+	proxyCmd.Flags().StringVarP(&flagTLSClientCA, "tls-client-ca", "", "", "require client certificates signed by this ca (tls only)")
+	proxyCmd.Flags().StringArrayVarP(&flagTLSClientPolicy, "tls-client-policy", "", []string{}, "allowed interfaces and addresses per client certificate (identity=iface,cidr,...; * for others)")
+	proxyCmd.Flags().StringVarP(&flagAdminListen, "admin-listen", "", "", "admin listen address")
+	proxyCmd.Flags().IntVarP(&flagPoolMaxIdle, "pool-max-idle", "", 1024, "max idle upstream connections")
+	proxyCmd.Flags().IntVarP(&flagPoolMaxIdlePerHost, "pool-max-idle-per-host", "", 16, "max idle upstream connections per source and host")
+	proxyCmd.Flags().IntVarP(&flagPoolMaxConnsPerHost, "pool-max-conns-per-host", "", 0, "max upstream connections per source and host (0 for unlimited)")
+	proxyCmd.Flags().DurationVarP(&flagPoolIdleTimeout, "pool-idle-timeout", "", 90*time.Second, "idle upstream connection timeout")
 	proxyCmd.Flags().StringSliceVarP(&flagPassword, "password", "p", []string{}, "password")
+	proxyCmd.Flags().StringVarP(&flagHtpasswd, "htpasswd", "", "", "htpasswd file with bcrypt or argon2 hashes (user names become user+selector)")
+	proxyCmd.Flags().StringArrayVarP(&flagUserACL, "user-acl", "", []string{}, "allowed interfaces and addresses per user (user=iface,cidr,...; * for others)")
+	proxyCmd.Flags().StringArrayVarP(&flagDestRule, "dest-rule", "", []string{}, "destination rule (allow|deny host [ports]), first match wins")
+	proxyCmd.Flags().BoolVarP(&flagDestNoDefault, "dest-no-default", "", false, "do not deny loopback, link-local and metadata destinations by default")
+	proxyCmd.Flags().StringVarP(&flagPoolStrategy, "pool-strategy", "", "random", "default source pool strategy (random, round-robin, least-conn)")
+	proxyCmd.Flags().DurationVarP(&flagSessionTTL, "session-ttl", "", 10*time.Minute, "idle lifetime of pool session leases")
+	proxyCmd.Flags().StringVarP(&flagSelectorHeader, "selector-header", "", "X-Maddr-Source", "request header that may carry a source selector in place of the user name (empty to disable)")
 	proxyCmd.Flags().BoolVarP(&flagSetupRoute, "setup-route", "", false, "setup route")
 	proxyCmd.Flags().StringSliceVarP(&flagSetupRouteIface, "setup-route-iface", "", []string{"en.*", "eth.*"}, "interface")
 	proxyCmd.Flags().StringSliceVarP(&flagSetupRouteGw, "setup-route-gw", "", []string{}, "gateway")
 	proxyCmd.Flags().BoolVarP(&flagSetupRouteUseHostMinAsGw, "setup-route-use-host-min-as-gw", "", true, "use host min as gateway")
+	proxyCmd.Flags().StringSliceVarP(&flagSetupRouteLocalPrefix, "setup-route-local-prefix", "", []string{}, "prefix to install as a local route for the prefix: selector")
+	proxyCmd.Flags().StringSliceVarP(&flagSetupRouteFwmark, "setup-route-fwmark", "", []string{}, "fwmark rule to install (mark=iface)")
+	proxyCmd.Flags().BoolVarP(&flagSetupRouteNoSourceRules, "setup-route-no-source-rules", "", false, "install only fwmark rules, not per-address rules")
+	proxyCmd.Flags().StringArrayVarP(&flagMark, "mark", "", []string{}, "named firewall mark for the mark: selector (name=mark)")
 	rootCmd.AddCommand(proxyCmd)
 	if err := rootCmd.Execute(); err != nil {
 		panic(err)
@@ -0,0 +1,89 @@
+package maddrproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (p *proxy) servePool(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, p.pool.stats())
+}
+
+func (p *proxy) serveLeases(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, p.leases.list())
+}
+
+func (p *proxy) serveNetns(w http.ResponseWriter, req *http.Request) {
+	namespaces, err := p.namespaces.list()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, namespaces)
+}
+
+func (p *proxy) serveHealth(w http.ResponseWriter, req *http.Request) {
+	if p.health == nil {
+		writeJSON(w, []healthInfo{})
+		return
+	}
+	writeJSON(w, p.health.list())
+}
+
+// serveMetrics exposes the pool, dns cache and health state in the
+// Prometheus text format.
+func (p *proxy) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	stats := p.pool.stats()
+	fmt.Fprintf(w, "# TYPE maddr_proxy_pool_dials_total counter\nmaddr_proxy_pool_dials_total %d\n", stats.Dials)
+	fmt.Fprintf(w, "# TYPE maddr_proxy_pool_reuses_total counter\nmaddr_proxy_pool_reuses_total %d\n", stats.Reuses)
+	fmt.Fprintf(w, "# TYPE maddr_proxy_pool_waits_total counter\nmaddr_proxy_pool_waits_total %d\n", stats.Waits)
+	fmt.Fprintf(w, "# TYPE maddr_proxy_pool_expired_total counter\nmaddr_proxy_pool_expired_total %d\n", stats.Expired)
+	fmt.Fprintf(w, "# TYPE maddr_proxy_pool_idle_connections gauge\nmaddr_proxy_pool_idle_connections %d\n", stats.Idle)
+	fmt.Fprintf(w, "# TYPE maddr_proxy_pool_active_connections gauge\nmaddr_proxy_pool_active_connections %d\n", stats.Active)
+	dns := p.dns.stats()
+	fmt.Fprintf(w, "# TYPE maddr_proxy_dns_cache_hits_total counter\nmaddr_proxy_dns_cache_hits_total %d\n", dns.Hits)
+	fmt.Fprintf(w, "# TYPE maddr_proxy_dns_cache_misses_total counter\nmaddr_proxy_dns_cache_misses_total %d\n", dns.Misses)
+	fmt.Fprintf(w, "# TYPE maddr_proxy_dns_cache_negative_hits_total counter\nmaddr_proxy_dns_cache_negative_hits_total %d\n", dns.NegativeHits)
+	fmt.Fprintf(w, "# TYPE maddr_proxy_dns_cache_entries gauge\nmaddr_proxy_dns_cache_entries %d\n", dns.Entries)
+
+	if p.health == nil {
+		return
+	}
+	health := p.health.list()
+	fmt.Fprintln(w, "# TYPE maddr_proxy_source_up gauge")
+	for _, h := range health {
+		up := 0
+		if h.Up {
+			up = 1
+		}
+		fmt.Fprintf(w, "maddr_proxy_source_up{address=%q,interface=%q} %d\n", h.Address, h.Interface, up)
+	}
+	fmt.Fprintln(w, "# TYPE maddr_proxy_source_probes_total counter")
+	for _, h := range health {
+		fmt.Fprintf(w, "maddr_proxy_source_probes_total{address=%q,interface=%q,result=\"success\"} %d\n", h.Address, h.Interface, h.Probes-h.Failed)
+		fmt.Fprintf(w, "maddr_proxy_source_probes_total{address=%q,interface=%q,result=\"failure\"} %d\n", h.Address, h.Interface, h.Failed)
+	}
+}
+
+func (p *proxy) ListenAndServeAdmin(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pool", p.servePool)
+	mux.HandleFunc("/leases", p.serveLeases)
+	mux.HandleFunc("/netns", p.serveNetns)
+	mux.HandleFunc("/health", p.serveHealth)
+	mux.HandleFunc("/metrics", p.serveMetrics)
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	return server.ListenAndServe()
+}
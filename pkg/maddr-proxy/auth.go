@@ -0,0 +1,75 @@
+package maddrproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/hrntknr/maddr-proxy/pkg/utils"
+)
+
+type principal struct {
+	name   string
+	user   string
+	policy *egressPolicy
+}
+
+func (p *proxy) newPrincipal(user string) *principal {
+	pr := &principal{user: user}
+	if p.identities {
+		pr.name, pr.user = utils.SplitUser(user)
+	}
+	if p.userPolicies != nil {
+		pr.policy = lookupPolicy(p.userPolicies, pr.name)
+	}
+	return pr
+}
+
+// authenticate identifies the client of req. A selector in the selector
+// header replaces the one in the user name; it only changes which source
+// is asked for, so the identity and its policy are the same either way.
+func (p *proxy) authenticate(req *http.Request) (*principal, int, error) {
+	pr, code, err := p.authenticateUser(req)
+	if err != nil {
+		return nil, code, err
+	}
+	if p.selectorKey != "" {
+		if values := req.Header.Values(p.selectorKey); len(values) > 1 {
+			return nil, http.StatusBadRequest, fmt.Errorf("multiple %s headers", p.selectorKey)
+		} else if len(values) == 1 {
+			pr.user = values[0]
+		}
+	}
+	return pr, http.StatusOK, nil
+}
+
+func (p *proxy) authenticateUser(req *http.Request) (*principal, int, error) {
+	if p.clientCAs != nil && req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		name, policy, err := lookupCertPolicy(p.certPolicies, req.TLS.VerifiedChains[0][0])
+		if err != nil {
+			return nil, http.StatusForbidden, err
+		}
+		user, _, err := utils.GetAuth(proxyAuthHeaderKey, req)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if p.identities {
+			_, user = utils.SplitUser(user)
+		}
+		return &principal{name: name, user: user, policy: policy}, http.StatusOK, nil
+	}
+
+	user, code, err := utils.ProxyAuthenticate(proxyAuthHeaderKey, p.verifier, req)
+	if err != nil {
+		return nil, code, err
+	}
+	return p.newPrincipal(user), http.StatusOK, nil
+}
+
+func errorStatus(err error) int {
+	var perr *policyError
+	if errors.As(err, &perr) {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,243 @@
+package maddrproxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCredentialFile(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("alice-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("0123456789abcdef")
+	argon2Hash := fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("bob-password"), salt, 1, 1024, 1, 32)))
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(file, []byte(fmt.Sprintf("alice:%s\nbob:%s\n", bcryptHash, argon2Hash)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewTestProxy([]string{})
+	if err := p.SetCredentialFile(file); err != nil {
+		t.Fatal(err)
+	}
+	dummyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer dummyServer.Close()
+
+	do := func(user *url.Userinfo) int {
+		resp, err := NewProxyClient(p, func(u *url.URL) { u.User = user }).Get(dummyServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	tt := []struct {
+		name     string
+		user     *url.Userinfo
+		expected int
+	}{
+		{name: "bcrypt", user: url.UserPassword("alice", "alice-password"), expected: http.StatusOK},
+		{name: "argon2", user: url.UserPassword("bob", "bob-password"), expected: http.StatusOK},
+		{name: "with selector", user: url.UserPassword("alice+127.0.0.1", "alice-password"), expected: http.StatusOK},
+		{name: "wrong password", user: url.UserPassword("alice", "bob-password"), expected: http.StatusForbidden},
+		{name: "unknown user", user: url.UserPassword("carol", "alice-password"), expected: http.StatusForbidden},
+		{name: "no password", user: url.User("alice"), expected: http.StatusProxyAuthRequired},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if code := do(tc.user); code != tc.expected {
+				t.Fatalf("expected status %d, got %d", tc.expected, code)
+			}
+		})
+	}
+
+	t.Run("reload", func(t *testing.T) {
+		if err := os.WriteFile(file, []byte(fmt.Sprintf("carol:%s\n", bcryptHash)), 0600); err != nil {
+			t.Fatal(err)
+		}
+		mod := time.Now().Add(time.Minute)
+		os.Chtimes(file, mod, mod)
+		if code := do(url.UserPassword("carol", "alice-password")); code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+		}
+		if code := do(url.UserPassword("alice", "alice-password")); code != http.StatusForbidden {
+			t.Fatalf("expected status %d, got %d", http.StatusForbidden, code)
+		}
+	})
+}
+
+func TestUserPolicies(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(file, []byte(fmt.Sprintf("alice:%s\nbob:%s\ncarol:%s\n", hash, hash, hash)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := NewTestProxy([]string{})
+	if err := p.SetCredentialFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetUserPolicies([]string{"alice=lo", "bob=203.0.113.0/28", "*=127.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	dummyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer dummyServer.Close()
+
+	tt := []struct {
+		name     string
+		user     string
+		expected int
+	}{
+		{name: "allowed interface", user: "alice+127.0.0.1", expected: http.StatusOK},
+		{name: "denied cidr", user: "bob+127.0.0.1", expected: http.StatusForbidden},
+		{name: "default policy", user: "carol+127.0.0.1", expected: http.StatusOK},
+		{name: "unselected address", user: "alice", expected: http.StatusForbidden},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := NewProxyClient(p, func(u *url.URL) {
+				u.User = url.UserPassword(tc.user, "password")
+			}).Get(dummyServer.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.expected {
+				t.Fatalf("expected status %d, got %d", tc.expected, resp.StatusCode)
+			}
+			if tc.expected == http.StatusForbidden && resp.Header.Get("X-Proxy-Error") == "" {
+				t.Fatal("expected X-Proxy-Error header")
+			}
+		})
+	}
+
+	// Clients without credentials fall back to the * entry on SOCKS as well.
+	open := NewTestProxy(nil)
+	if err := open.SetUserPolicies([]string{"*=192.0.2.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := NewProxyClient(open, nil).Get(dummyServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+	ln, err := NewSocksListener(open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := SocksHandshake(conn, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SocksRequest(conn, socksCmdConnect, dummyServer.Listener.Addr().String()); err == nil {
+		t.Fatal("expected the * policy to deny the socks request")
+	}
+}
+
+func TestSelectorHeader(t *testing.T) {
+	p := NewTestProxy([]string{})
+	if err := p.SetUserPolicies([]string{"*=127.0.0.2/32"}); err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(selectorHeaderKey) != "" || r.Header.Get("X-Egress") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		w.Header().Set("X-Remote", host)
+		w.WriteHeader(http.StatusOK)
+	})
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+
+	tt := []struct {
+		name     string
+		key      string
+		values   []string
+		expected int
+	}{
+		{name: "allowed", key: selectorHeaderKey, values: []string{"addr=127.0.0.2"}, expected: http.StatusOK},
+		{name: "legacy form", key: selectorHeaderKey, values: []string{"127.0.0.2"}, expected: http.StatusOK},
+		{name: "denied", key: selectorHeaderKey, values: []string{"addr=127.0.0.3"}, expected: http.StatusForbidden},
+		{name: "unselected", key: selectorHeaderKey, expected: http.StatusForbidden},
+		{name: "multiple", key: selectorHeaderKey, values: []string{"addr=127.0.0.2", "addr=127.0.0.3"}, expected: http.StatusBadRequest},
+		{name: "renamed", key: "X-Egress", values: []string{"addr=127.0.0.2"}, expected: http.StatusOK},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			p.SetSelectorHeader(tc.key)
+			header := http.Header{}
+			for _, v := range tc.values {
+				header.Add(tc.key, v)
+			}
+
+			client := NewProxyClient(p, func(u *url.URL) {
+				u.User = url.UserPassword("", "")
+			})
+			req, err := http.NewRequest(http.MethodGet, httpServer.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header = header.Clone()
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.expected {
+				t.Fatalf("expected status %d, got %d", tc.expected, resp.StatusCode)
+			}
+			if tc.expected == http.StatusOK && resp.Header.Get("X-Remote") != "127.0.0.2" {
+				t.Fatalf("expected request from 127.0.0.2, got %s", resp.Header.Get("X-Remote"))
+			}
+
+			client.Transport.(*http.Transport).ProxyConnectHeader = header
+			resp, err = client.Get(tlsServer.URL)
+			if tc.expected != http.StatusOK {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("expected CONNECT to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.Header.Get("X-Remote") != "127.0.0.2" {
+				t.Fatalf("expected CONNECT from 127.0.0.2, got %s", resp.Header.Get("X-Remote"))
+			}
+		})
+	}
+}
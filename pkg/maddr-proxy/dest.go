@@ -0,0 +1,164 @@
+package maddrproxy
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultDestRules keep clients from reaching the proxy host itself and
+// cloud metadata services. They are evaluated after any configured rules.
+var defaultDestRules = []string{
+	"deny 127.0.0.0/8",
+	"deny ::1/128",
+	"deny 0.0.0.0/8",
+	"deny ::/128",
+	"deny 169.254.0.0/16",
+	"deny fe80::/10",
+	"deny fd00:ec2::254/128",
+	"deny 100.100.100.200/32",
+}
+
+type portRange struct {
+	from int
+	to   int
+}
+
+type destRule struct {
+	allow  bool
+	any    bool
+	ipnet  *net.IPNet
+	domain string
+	re     *regexp.Regexp
+	ports  []portRange
+}
+
+type destPolicy struct {
+	rules []destRule
+}
+
+// parseDestRule parses "<allow|deny> <host> [ports]", where host is *, an
+// address or CIDR, a domain (a leading dot also matches subdomains) or
+// ~regexp, and ports is a comma separated list of ports or ranges.
+func parseDestRule(s string) (destRule, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 || len(fields) > 3 {
+		return destRule{}, fmt.Errorf("invalid destination rule: %s", s)
+	}
+	rule := destRule{}
+	switch fields[0] {
+	case "allow":
+		rule.allow = true
+	case "deny":
+	default:
+		return destRule{}, fmt.Errorf("invalid destination rule action: %s", fields[0])
+	}
+
+	host := fields[1]
+	if _, ipnet, err := net.ParseCIDR(host); err == nil {
+		rule.ipnet = ipnet
+	} else if ip := net.ParseIP(host); ip != nil {
+		mask := net.IPv6len * 8
+		if ip.To4() != nil {
+			ip, mask = ip.To4(), net.IPv4len*8
+		}
+		rule.ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(mask, mask)}
+	} else if host == "*" {
+		rule.any = true
+	} else if strings.HasPrefix(host, "~") {
+		re, err := regexp.Compile(host[1:])
+		if err != nil {
+			return destRule{}, fmt.Errorf("invalid destination pattern %q: %w", host, err)
+		}
+		rule.re = re
+	} else {
+		rule.domain = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+
+	if len(fields) == 3 {
+		for _, p := range strings.Split(fields[2], ",") {
+			from, to, found := strings.Cut(p, "-")
+			if !found {
+				to = from
+			}
+			f, err := strconv.Atoi(from)
+			if err != nil {
+				return destRule{}, fmt.Errorf("invalid destination port: %s", p)
+			}
+			t, err := strconv.Atoi(to)
+			if err != nil {
+				return destRule{}, fmt.Errorf("invalid destination port: %s", p)
+			}
+			if f < 0 || f > 65535 || t < 0 || t > 65535 || f > t {
+				return destRule{}, fmt.Errorf("invalid destination port range: %s", p)
+			}
+			rule.ports = append(rule.ports, portRange{from: f, to: t})
+		}
+	}
+	return rule, nil
+}
+
+func newDestPolicy(rules []string, defaults bool) (*destPolicy, error) {
+	if defaults {
+		rules = append(append([]string{}, rules...), defaultDestRules...)
+	}
+	policy := &destPolicy{}
+	for _, r := range rules {
+		rule, err := parseDestRule(r)
+		if err != nil {
+			return nil, err
+		}
+		policy.rules = append(policy.rules, rule)
+	}
+	return policy, nil
+}
+
+func (r *destRule) match(host string, port int, ip net.IP) bool {
+	if len(r.ports) > 0 {
+		found := false
+		for _, p := range r.ports {
+			if port >= p.from && port <= p.to {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	switch {
+	case r.any:
+		return true
+	case r.ipnet != nil:
+		return r.ipnet.Contains(ip)
+	case r.re != nil:
+		return r.re.MatchString(host)
+	case strings.HasPrefix(r.domain, "."):
+		return host == r.domain[1:] || strings.HasSuffix(host, r.domain)
+	default:
+		return host == r.domain
+	}
+}
+
+// check evaluates every resolved address on its own, so that a name
+// resolving to both an allowed and a denied address is rejected.
+func (d *destPolicy) check(host string, port int, ips []net.IP) error {
+	if d == nil {
+		return nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, ip := range ips {
+		for _, rule := range d.rules {
+			if !rule.match(host, port, ip) {
+				continue
+			}
+			if !rule.allow {
+				return &policyError{fmt.Errorf("destination %s is denied", net.JoinHostPort(ip.String(), strconv.Itoa(port)))}
+			}
+			break
+		}
+	}
+	return nil
+}
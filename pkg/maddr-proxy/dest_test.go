@@ -0,0 +1,97 @@
+package maddrproxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDestPolicy(t *testing.T) {
+	policy, err := newDestPolicy([]string{
+		"allow 10.1.0.0/16",
+		"deny 10.0.0.0/8",
+		"deny .internal.example.com",
+		"deny ~^admin\\.",
+		"deny * 25,6000-6063",
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt := []struct {
+		name    string
+		host    string
+		port    int
+		ips     []string
+		allowed bool
+	}{
+		{name: "public", host: "example.com", port: 443, ips: []string{"93.184.216.34"}, allowed: true},
+		{name: "allowed before denied cidr", host: "10.1.2.3", port: 443, ips: []string{"10.1.2.3"}, allowed: true},
+		{name: "denied cidr", host: "10.2.0.1", port: 443, ips: []string{"10.2.0.1"}, allowed: false},
+		{name: "domain suffix", host: "db.internal.example.com", port: 443, ips: []string{"93.184.216.34"}, allowed: false},
+		{name: "domain itself", host: "internal.example.com.", port: 443, ips: []string{"93.184.216.34"}, allowed: false},
+		{name: "regexp", host: "admin.example.com", port: 443, ips: []string{"93.184.216.34"}, allowed: false},
+		{name: "port", host: "example.com", port: 25, ips: []string{"93.184.216.34"}, allowed: false},
+		{name: "port range", host: "example.com", port: 6010, ips: []string{"93.184.216.34"}, allowed: false},
+		{name: "default loopback", host: "localhost", port: 80, ips: []string{"127.0.0.1"}, allowed: false},
+		{name: "default metadata", host: "169.254.169.254", port: 80, ips: []string{"169.254.169.254"}, allowed: false},
+		{name: "default mapped loopback", host: "::ffff:127.0.0.1", port: 80, ips: []string{"::ffff:127.0.0.1"}, allowed: false},
+		{name: "any resolved address", host: "rebind.example.com", port: 80, ips: []string{"93.184.216.34", "127.0.0.1"}, allowed: false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ips := []net.IP{}
+			for _, ip := range tc.ips {
+				ips = append(ips, net.ParseIP(ip))
+			}
+			err := policy.check(tc.host, tc.port, ips)
+			if tc.allowed && err != nil {
+				t.Fatalf("expected allowed, got %v", err)
+			}
+			if !tc.allowed && err == nil {
+				t.Fatal("expected denied")
+			}
+		})
+	}
+}
+
+func TestParseDestRule(t *testing.T) {
+	for _, rule := range []string{
+		"deny * 0",
+		"deny * 65535",
+		"deny * 80-443",
+		"deny * 443-443",
+	} {
+		if _, err := parseDestRule(rule); err != nil {
+			t.Fatalf("%s: %v", rule, err)
+		}
+	}
+	for _, rule := range []string{
+		"deny * 70000",
+		"deny * -1",
+		"deny * 80-70000",
+		"deny * 443-80",
+		"deny * http",
+		"block *",
+		"deny",
+	} {
+		if _, err := parseDestRule(rule); err == nil {
+			t.Fatalf("expected error for %q", rule)
+		}
+	}
+}
+
+func TestDestPolicyDefault(t *testing.T) {
+	dummyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer dummyServer.Close()
+	resp, err := NewProxyClient(NewProxy([]string{}), nil).Get(dummyServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+}
@@ -0,0 +1,318 @@
+package maddrproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const dnsCacheSize = 10000
+
+// Answers are kept for at least dnsMinTTL, so that deciding the family
+// and dialing share one lookup even for records with a zero TTL.
+const dnsMinTTL = 1 * time.Second
+const dnsMaxTTL = 1 * time.Hour
+
+// dnsNegativeTTL is used for failed lookups without an SOA record, and
+// dnsDefaultTTL for answers that did not come from DNS (e.g. /etc/hosts).
+const dnsNegativeTTL = 30 * time.Second
+const dnsDefaultTTL = 60 * time.Second
+
+type dialFunc = func(context.Context, string, string) (net.Conn, error)
+
+type dnsKey struct {
+	scope string
+	host  string
+}
+
+type dnsEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+	ready   chan struct{}
+}
+
+type dnsStats struct {
+	Hits         uint64 `json:"hits"`
+	Misses       uint64 `json:"misses"`
+	NegativeHits uint64 `json:"negative_hits"`
+	Entries      int    `json:"entries"`
+}
+
+// dnsCache shares lookups between requests for as long as the TTLs of the
+// answers allow. Concurrent lookups of the same name wait for the first.
+type dnsCache struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[dnsKey]*dnsEntry
+	hits    uint64
+	misses  uint64
+	neghits uint64
+}
+
+func newDNSCache(size int) *dnsCache {
+	return &dnsCache{
+		size:    size,
+		entries: map[dnsKey]*dnsEntry{},
+	}
+}
+
+func (c *dnsCache) lookup(ctx context.Context, key dnsKey, dial dialFunc) ([]net.IP, error) {
+	if ip := net.ParseIP(key.host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if c == nil || c.size <= 0 {
+		ips, _, err := lookupTTL(ctx, key.host, dial)
+		return ips, err
+	}
+
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		select {
+		case <-e.ready:
+			if time.Now().Before(e.expires) {
+				c.hits++
+				if e.err != nil {
+					c.neghits++
+				}
+				c.mu.Unlock()
+				return e.ips, e.err
+			}
+		default:
+			c.hits++
+			c.mu.Unlock()
+			select {
+			case <-e.ready:
+				return e.ips, e.err
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+	c.misses++
+	e := &dnsEntry{ready: make(chan struct{})}
+	c.evict()
+	c.entries[key] = e
+	c.mu.Unlock()
+
+	// The lookup is not tied to the request, whose cancellation would
+	// otherwise fail every request waiting on the same entry.
+	lctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ips, ttl, err := lookupTTL(lctx, key.host, dial)
+	if ttl < dnsMinTTL {
+		ttl = dnsMinTTL
+	}
+	var derr *net.DNSError
+	if err != nil && !(errors.As(err, &derr) && derr.IsNotFound) {
+		// Only cache answers, not timeouts or unreachable nameservers.
+		ttl = 0
+	}
+	e.ips, e.err, e.expires = ips, err, time.Now().Add(ttl)
+	close(e.ready)
+	return ips, err
+}
+
+// evict makes room for a new entry, dropping expired entries first.
+func (c *dnsCache) evict() {
+	if len(c.entries) < c.size {
+		return
+	}
+	now := time.Now()
+	for k, e := range c.entries {
+		select {
+		case <-e.ready:
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		default:
+		}
+	}
+	for k := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+		delete(c.entries, k)
+	}
+}
+
+func (c *dnsCache) stats() dnsStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return dnsStats{
+		Hits:         c.hits,
+		Misses:       c.misses,
+		NegativeHits: c.neghits,
+		Entries:      len(c.entries),
+	}
+}
+
+// ttlRecorder collects the lowest TTL of the DNS responses read through
+// the connections it wraps.
+type ttlRecorder struct {
+	mu  sync.Mutex
+	ttl time.Duration
+	set bool
+}
+
+func (r *ttlRecorder) observe(ttl uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := time.Duration(ttl) * time.Second
+	if !r.set || d < r.ttl {
+		r.ttl, r.set = d, true
+	}
+}
+
+// parse records the TTLs of the answers in msg, or the negative caching
+// TTL from the SOA record of a response without answers (RFC 2308).
+func (r *ttlRecorder) parse(msg []byte) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	answers := 0
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			break
+		}
+		if h.Type == dnsmessage.TypeA || h.Type == dnsmessage.TypeAAAA || h.Type == dnsmessage.TypeCNAME {
+			r.observe(h.TTL)
+			answers++
+		}
+		if err := p.SkipAnswer(); err != nil {
+			return
+		}
+	}
+	if answers > 0 {
+		return
+	}
+	for {
+		h, err := p.AuthorityHeader()
+		if err != nil {
+			return
+		}
+		if h.Type != dnsmessage.TypeSOA {
+			if err := p.SkipAuthority(); err != nil {
+				return
+			}
+			continue
+		}
+		soa, err := p.SOAResource()
+		if err != nil {
+			return
+		}
+		r.observe(min(h.TTL, soa.MinTTL))
+		return
+	}
+}
+
+type ttlConn struct {
+	net.Conn
+	rec    *ttlRecorder
+	stream bool
+	buf    []byte
+}
+
+func (c *ttlConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if !c.stream {
+			c.rec.parse(b[:n])
+		} else {
+			// DNS over TCP prefixes every message with its length.
+			c.buf = append(c.buf, b[:n]...)
+			for len(c.buf) >= 2 {
+				l := int(binary.BigEndian.Uint16(c.buf))
+				if len(c.buf) < 2+l {
+					break
+				}
+				c.rec.parse(c.buf[2 : 2+l])
+				c.buf = c.buf[2+l:]
+			}
+		}
+	}
+	return n, err
+}
+
+// ttlPacketConn keeps the wrapped connection a net.PacketConn, which is
+// how the Go resolver tells UDP from TCP framing.
+type ttlPacketConn struct {
+	*ttlConn
+	pc net.PacketConn
+}
+
+func (c *ttlPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.pc.ReadFrom(b)
+	if n > 0 {
+		c.rec.parse(b[:n])
+	}
+	return n, addr, err
+}
+
+func (c *ttlPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.pc.WriteTo(b, addr)
+}
+
+// lookupTTL resolves host with the Go resolver, through dial if given,
+// and returns the TTL observed on the wire along with the addresses.
+func lookupTTL(ctx context.Context, host string, dial dialFunc) ([]net.IP, time.Duration, error) {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	rec := &ttlRecorder{}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			conn, err := dial(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			if pc, ok := conn.(net.PacketConn); ok {
+				return &ttlPacketConn{ttlConn: &ttlConn{Conn: conn, rec: rec}, pc: pc}, nil
+			}
+			return &ttlConn{Conn: conn, rec: rec, stream: true}, nil
+		},
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	ttl := dnsDefaultTTL
+	if err != nil {
+		ttl = dnsNegativeTTL
+	}
+	rec.mu.Lock()
+	if rec.set {
+		ttl = rec.ttl
+	}
+	rec.mu.Unlock()
+	if ttl > dnsMaxTTL {
+		ttl = dnsMaxTTL
+	}
+	if err != nil {
+		return nil, ttl, err
+	}
+	ips := []net.IP{}
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	return ips, ttl, nil
+}
+
+// lookupHost resolves host for src, answering from the cache when it can.
+func (p *proxy) lookupHost(ctx context.Context, src *source, host string) ([]net.IP, error) {
+	scope, dial := p.dnsDialer(src)
+	return p.dns.lookup(ctx, dnsKey{scope: scope, host: host}, dial)
+}
+
+func (p *proxy) SetDNSCache(size int) {
+	p.dns = newDNSCache(size)
+}
@@ -0,0 +1,124 @@
+package maddrproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveDNS answers A queries for found.test with 192.0.2.1 and everything
+// else with NXDOMAIN, counting the queries it receives.
+func serveDNS(t *testing.T, ttl uint32) (string, *atomic.Int32) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	queries := &atomic.Int32{}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			queries.Add(1)
+			h.Response, h.Authoritative = true, true
+			b := dnsmessage.NewBuilder(nil, h)
+			b.EnableCompression()
+			b.StartQuestions()
+			b.Question(q)
+			switch {
+			case q.Name.String() != "found.test.":
+				h.RCode = dnsmessage.RCodeNameError
+				b = dnsmessage.NewBuilder(nil, h)
+				b.StartQuestions()
+				b.Question(q)
+				b.StartAuthorities()
+				b.SOAResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: ttl}, dnsmessage.SOAResource{
+					NS:     dnsmessage.MustNewName("ns.test."),
+					MBox:   dnsmessage.MustNewName("admin.test."),
+					MinTTL: ttl,
+				})
+			case q.Type == dnsmessage.TypeA:
+				b.StartAnswers()
+				b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: ttl}, dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+			}
+			msg, err := b.Finish()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(msg, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), queries
+}
+
+func TestDNSCache(t *testing.T) {
+	server, queries := serveDNS(t, 1)
+	dial := func(ctx context.Context, network string, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, server)
+	}
+	c := newDNSCache(10)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		ips, err := c.lookup(ctx, dnsKey{host: "found.test"}, dial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+			t.Fatalf("unexpected answer: %v", ips)
+		}
+	}
+	// A and AAAA are queried once each.
+	if n := queries.Load(); n != 2 {
+		t.Fatalf("expected 2 queries, got %d", n)
+	}
+	if s := c.stats(); s.Hits != 2 || s.Misses != 1 || s.Entries != 1 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := c.lookup(ctx, dnsKey{host: "missing.test"}, dial)
+		var derr *net.DNSError
+		if !errors.As(err, &derr) || !derr.IsNotFound {
+			t.Fatalf("expected not found, got %v", err)
+		}
+	}
+	if s := c.stats(); s.NegativeHits != 1 || s.Misses != 2 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+
+	// Another scope does not share the answers.
+	if _, err := c.lookup(ctx, dnsKey{scope: "/eth1", host: "found.test"}, dial); err != nil {
+		t.Fatal(err)
+	}
+	if s := c.stats(); s.Misses != 3 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+
+	// The entries expire with their TTL.
+	time.Sleep(1100 * time.Millisecond)
+	before := queries.Load()
+	if _, err := c.lookup(ctx, dnsKey{host: "found.test"}, dial); err != nil {
+		t.Fatal(err)
+	}
+	if queries.Load() == before {
+		t.Fatal("expected a new query after the ttl expired")
+	}
+}
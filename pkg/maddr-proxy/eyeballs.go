@@ -0,0 +1,101 @@
+package maddrproxy
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// connectionAttemptDelay is the delay between connection attempts
+// recommended by RFC 8305 section 5.
+const connectionAttemptDelay = 250 * time.Millisecond
+
+type dialAttempt struct {
+	src  *source
+	addr string
+}
+
+// eyeballsAttempts interleaves the target addresses of the two families,
+// starting with the family of src, as in RFC 8305 section 4.
+func eyeballsAttempts(src *source, ips []net.IP, port string) []dialAttempt {
+	primary, secondary := []dialAttempt{}, []dialAttempt{}
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), port)
+		if matchFamily(src.network, ip) {
+			primary = append(primary, dialAttempt{src: src, addr: addr})
+		} else if matchFamily(src.eyeballs.network, ip) {
+			secondary = append(secondary, dialAttempt{src: src.eyeballs, addr: addr})
+		}
+	}
+	ret := []dialAttempt{}
+	for i := 0; i < len(primary) || i < len(secondary); i++ {
+		if i < len(primary) {
+			ret = append(ret, primary[i])
+		}
+		if i < len(secondary) {
+			ret = append(ret, secondary[i])
+		}
+	}
+	return ret
+}
+
+// raceDial starts the attempts one after another, each after the previous
+// one failed or connectionAttemptDelay passed, and keeps the first
+// connection that succeeds.
+func (p *proxy) raceDial(ctx context.Context, attempts []dialAttempt) (net.Conn, *source, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		src  *source
+		err  error
+	}
+	results := make(chan result, len(attempts))
+	next, pending := 0, 0
+	start := func() {
+		a := attempts[next]
+		next++
+		pending++
+		go func() {
+			conn, err := p.dialAddr(ctx, a.src, a.addr)
+			results <- result{conn: conn, src: a.src, err: err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(connectionAttemptDelay)
+	defer timer.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close the connections of attempts that are still in
+				// flight once they complete.
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, r.src, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(attempts) {
+				start()
+				timer.Reset(connectionAttemptDelay)
+			}
+		case <-timer.C:
+			if next < len(attempts) {
+				start()
+				timer.Reset(connectionAttemptDelay)
+			}
+		}
+	}
+	return nil, nil, firstErr
+}
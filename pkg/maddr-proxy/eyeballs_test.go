@@ -0,0 +1,60 @@
+package maddrproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestEyeballsAttempts(t *testing.T) {
+	src := newSource(net.ParseIP("2001:db8::1"), "tcp6")
+	src.eyeballs = newSource(net.ParseIP("192.0.2.1"), "tcp4")
+	ips := []net.IP{net.ParseIP("2001:db8::80"), net.ParseIP("2001:db8::81"), net.ParseIP("198.51.100.80")}
+	attempts := eyeballsAttempts(src, ips, "80")
+	expected := []string{"[2001:db8::80]:80", "198.51.100.80:80", "[2001:db8::81]:80"}
+	if len(attempts) != len(expected) {
+		t.Fatalf("unexpected attempts %v", attempts)
+	}
+	for i, a := range attempts {
+		if a.addr != expected[i] {
+			t.Fatalf("attempt %d: expected %s, got %s", i, expected[i], a.addr)
+		}
+	}
+	if attempts[1].src != src.eyeballs {
+		t.Fatal("expected the ipv4 attempt to use the ipv4 source")
+	}
+}
+
+func TestRaceDial(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	closed, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	p := NewTestProxy(nil)
+	refused := &source{network: "tcp4"}
+	ok := &source{network: "tcp4"}
+	conn, used, err := p.raceDial(context.Background(), []dialAttempt{
+		{src: refused, addr: closed.Addr().String()},
+		{src: ok, addr: ln.Addr().String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if used != ok {
+		t.Fatal("expected the second attempt to win")
+	}
+
+	if _, _, err := p.raceDial(context.Background(), []dialAttempt{
+		{src: refused, addr: closed.Addr().String()},
+	}); err == nil {
+		t.Fatal("expected error when every attempt fails")
+	}
+}
@@ -0,0 +1,307 @@
+package maddrproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hrntknr/maddr-proxy/pkg/utils"
+)
+
+const healthTimeout = 5 * time.Second
+
+type healthState struct {
+	iface     string
+	up        bool
+	successes int
+	failures  int
+	checked   time.Time
+	lastErr   string
+	probes    uint64
+	failed    uint64
+}
+
+type healthInfo struct {
+	Address   string    `json:"address"`
+	Interface string    `json:"interface"`
+	Up        bool      `json:"up"`
+	Successes int       `json:"successes"`
+	Failures  int       `json:"failures"`
+	Checked   time.Time `json:"checked"`
+	Error     string    `json:"error,omitempty"`
+	Probes    uint64    `json:"probes"`
+	Failed    uint64    `json:"failed"`
+}
+
+type healthTarget struct {
+	url  *url.URL
+	ipv4 bool
+	ipv6 bool
+}
+
+// healthChecker probes the targets from every source address. An address
+// goes down after fall consecutive failed rounds and comes back up after
+// rise consecutive successful ones; it starts out up.
+type healthChecker struct {
+	targets  []*url.URL
+	interval time.Duration
+	rise     int
+	fall     int
+	dns      *dnsCache
+
+	mu     sync.RWMutex
+	states map[string]*healthState
+}
+
+func parseHealthTarget(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid health target: %w", err)
+	}
+	switch u.Scheme {
+	case "tcp":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return nil, fmt.Errorf("invalid health target: %w", err)
+		}
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("invalid health target scheme: %s", s)
+	}
+	return u, nil
+}
+
+func newHealthChecker(targets []string, interval time.Duration, rise int, fall int) (*healthChecker, error) {
+	if interval <= 0 {
+		return nil, errors.New("health interval must be positive")
+	}
+	if rise < 1 || fall < 1 {
+		return nil, errors.New("health rise and fall must be at least 1")
+	}
+	h := &healthChecker{
+		interval: interval,
+		rise:     rise,
+		fall:     fall,
+		states:   map[string]*healthState{},
+	}
+	for _, t := range targets {
+		u, err := parseHealthTarget(t)
+		if err != nil {
+			return nil, err
+		}
+		h.targets = append(h.targets, u)
+	}
+	return h, nil
+}
+
+// resolveTargets looks up the families of the targets once per round, so
+// that an address is only probed against targets it can reach.
+func (h *healthChecker) resolveTargets() []healthTarget {
+	ret := []healthTarget{}
+	for _, u := range h.targets {
+		ips, err := h.dns.lookup(context.Background(), dnsKey{host: u.Hostname()}, nil)
+		if err != nil {
+			continue
+		}
+		ipv4, ipv6 := ipFamilies(ips)
+		ret = append(ret, healthTarget{url: u, ipv4: ipv4, ipv6: ipv6})
+	}
+	return ret
+}
+
+func probe(ctx context.Context, ip net.IP, target *url.URL) error {
+	network := "tcp6"
+	if ip.To4() != nil {
+		network = "tcp4"
+	}
+	dial := utils.GetDialContext(healthTimeout, &net.TCPAddr{IP: ip, Port: 0})
+	switch target.Scheme {
+	case "tcp":
+		conn, err := dial(ctx, network, target.Host)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	default:
+		client := &http.Client{
+			Timeout: healthTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _ string, addr string) (net.Conn, error) {
+					return dial(ctx, network, addr)
+				},
+				DisableKeepAlives: true,
+			},
+		}
+		resp, err := client.Get(target.String())
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// check probes every candidate concurrently. A candidate passes when any
+// target of its family answers.
+func (h *healthChecker) check(ctx context.Context, candidates []sourceCandidate) {
+	targets := h.resolveTargets()
+	wg := sync.WaitGroup{}
+	for _, c := range candidates {
+		applicable := []*url.URL{}
+		for _, t := range targets {
+			if c.ip.To4() != nil && t.ipv4 || c.ip.To4() == nil && t.ipv6 {
+				applicable = append(applicable, t.url)
+			}
+		}
+		if len(applicable) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(c sourceCandidate) {
+			defer wg.Done()
+			var err error
+			for _, t := range applicable {
+				if err = probe(ctx, c.ip, t); err == nil {
+					break
+				}
+			}
+			h.update(c, err)
+		}(c)
+	}
+	wg.Wait()
+}
+
+func (h *healthChecker) update(c sourceCandidate, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := c.ip.String()
+	s, ok := h.states[key]
+	if !ok {
+		s = &healthState{up: true}
+		h.states[key] = s
+	}
+	s.iface = c.iface
+	s.checked = time.Now()
+	s.probes++
+	if err == nil {
+		s.lastErr = ""
+		s.failures = 0
+		s.successes++
+		if s.successes >= h.rise {
+			s.up = true
+		}
+	} else {
+		s.lastErr = err.Error()
+		s.failed++
+		s.successes = 0
+		s.failures++
+		if s.failures >= h.fall {
+			s.up = false
+		}
+	}
+}
+
+func (h *healthChecker) isUp(ip net.IP) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	s, ok := h.states[ip.String()]
+	return !ok || s.up
+}
+
+// filter drops the candidates that are down. If all of them are down the
+// list is returned unchanged, as failing every request would not help.
+func (h *healthChecker) filter(candidates []sourceCandidate) []sourceCandidate {
+	if h == nil {
+		return candidates
+	}
+	ret := []sourceCandidate{}
+	for _, c := range candidates {
+		if h.isUp(c.ip) {
+			ret = append(ret, c)
+		}
+	}
+	if len(ret) == 0 {
+		return candidates
+	}
+	return ret
+}
+
+func (h *healthChecker) list() []healthInfo {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ret := []healthInfo{}
+	for addr, s := range h.states {
+		ret = append(ret, healthInfo{
+			Address:   addr,
+			Interface: s.iface,
+			Up:        s.up,
+			Successes: s.successes,
+			Failures:  s.failures,
+			Checked:   s.checked,
+			Error:     s.lastErr,
+			Probes:    s.probes,
+			Failed:    s.failed,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Address < ret[j].Address
+	})
+	return ret
+}
+
+// managedCandidates lists every address the pool selector "all" can pick.
+func managedCandidates(addrs *addrInventory) ([]sourceCandidate, error) {
+	all := &poolSpec{match: []string{"all"}}
+	ret := []sourceCandidate{}
+	for _, ipv6 := range []bool{false, true} {
+		candidates, err := all.candidates(addrs, ipv6, nil)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, candidates...)
+	}
+	return ret, nil
+}
+
+func (p *proxy) SetHealthCheck(targets []string, interval time.Duration, rise int, fall int) error {
+	if len(targets) == 0 {
+		p.health = nil
+		return nil
+	}
+	h, err := newHealthChecker(targets, interval, rise, fall)
+	if err != nil {
+		return err
+	}
+	h.dns = p.dns
+	p.health = h
+	return nil
+}
+
+// RunHealthCheck probes all managed addresses every interval. It returns
+// immediately when no health targets are configured.
+func (p *proxy) RunHealthCheck() error {
+	h := p.health
+	if h == nil {
+		return nil
+	}
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		candidates, err := managedCandidates(p.addrs)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), h.interval)
+		h.check(ctx, candidates)
+		cancel()
+		<-ticker.C
+	}
+}
@@ -0,0 +1,75 @@
+package maddrproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	dummyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer dummyServer.Close()
+
+	for _, target := range []string{"ftp://example.com/", "tcp://example.com"} {
+		if _, err := newHealthChecker([]string{target}, time.Second, 2, 2); err == nil {
+			t.Fatalf("expected error for %s", target)
+		}
+	}
+	p := NewTestProxy(nil)
+	for _, tc := range []struct {
+		interval   time.Duration
+		rise, fall int
+	}{
+		{interval: 0, rise: 2, fall: 2},
+		{interval: -time.Second, rise: 2, fall: 2},
+		{interval: time.Second, rise: 0, fall: 2},
+		{interval: time.Second, rise: 2, fall: 0},
+	} {
+		if err := p.SetHealthCheck([]string{dummyServer.URL}, tc.interval, tc.rise, tc.fall); err == nil {
+			t.Fatalf("expected error for %+v", tc)
+		}
+	}
+	h, err := newHealthChecker([]string{dummyServer.URL}, time.Second, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := sourceCandidate{iface: "lo", ip: net.ParseIP("127.0.0.1")}
+	other := sourceCandidate{iface: "eth1", ip: net.ParseIP("192.0.2.1")}
+	round := func(expected bool) {
+		t.Helper()
+		h.check(context.Background(), []sourceCandidate{local})
+		if up := h.isUp(local.ip); up != expected {
+			t.Fatalf("expected up=%v, got %v: %+v", expected, up, h.list())
+		}
+	}
+
+	round(true)
+	healthy.Store(false)
+	round(true)
+	round(false)
+	if c := h.filter([]sourceCandidate{local, other}); len(c) != 1 || !c[0].ip.Equal(other.ip) {
+		t.Fatalf("expected down address to be filtered, got %v", c)
+	}
+	if c := h.filter([]sourceCandidate{local}); len(c) != 1 {
+		t.Fatal("expected all-down candidates to be kept")
+	}
+
+	healthy.Store(true)
+	round(false)
+	round(true)
+	if info := h.list(); len(info) != 1 || info[0].Probes != 5 || info[0].Failed != 2 {
+		t.Fatalf("unexpected health state %+v", info)
+	}
+}
@@ -0,0 +1,160 @@
+package maddrproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/vishvananda/netlink"
+)
+
+type ifaceAddrs struct {
+	name  string
+	index int
+	addrs []*net.IPNet
+}
+
+type addrSnapshot struct {
+	ifaces []*ifaceAddrs
+	byName map[string]*ifaceAddrs
+}
+
+func newAddrSnapshot(ifaces []*ifaceAddrs) *addrSnapshot {
+	s := &addrSnapshot{ifaces: ifaces, byName: map[string]*ifaceAddrs{}}
+	for _, iface := range ifaces {
+		s.byName[iface.name] = iface
+	}
+	return s
+}
+
+// addrInventory holds the interfaces and addresses of the host. Once
+// RunAddrInventory has loaded them from netlink, lookups read an immutable
+// snapshot that is replaced on every address or link change; until then,
+// and on a nil inventory, they fall back to the net package.
+type addrInventory struct {
+	snapshot atomic.Pointer[addrSnapshot]
+}
+
+func newAddrInventory() *addrInventory {
+	return &addrInventory{}
+}
+
+func loadAddrSnapshot() (*addrSnapshot, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := netlink.AddrList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	byIndex := map[int]*ifaceAddrs{}
+	ifaces := []*ifaceAddrs{}
+	for _, link := range links {
+		iface := &ifaceAddrs{name: link.Attrs().Name, index: link.Attrs().Index}
+		byIndex[iface.index] = iface
+		ifaces = append(ifaces, iface)
+	}
+	for _, a := range addrs {
+		if iface, ok := byIndex[a.LinkIndex]; ok && a.IPNet != nil {
+			iface.addrs = append(iface.addrs, a.IPNet)
+		}
+	}
+	return newAddrSnapshot(ifaces), nil
+}
+
+func netAddrSnapshot() (*addrSnapshot, error) {
+	netIfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	ifaces := []*ifaceAddrs{}
+	for _, netIface := range netIfaces {
+		iface := &ifaceAddrs{name: netIface.Name, index: netIface.Index}
+		addrs, _ := netIface.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				iface.addrs = append(iface.addrs, ipnet)
+			}
+		}
+		ifaces = append(ifaces, iface)
+	}
+	return newAddrSnapshot(ifaces), nil
+}
+
+func (a *addrInventory) current() (*addrSnapshot, error) {
+	if a != nil {
+		if s := a.snapshot.Load(); s != nil {
+			return s, nil
+		}
+	}
+	return netAddrSnapshot()
+}
+
+func (a *addrInventory) interfaces() ([]*ifaceAddrs, error) {
+	s, err := a.current()
+	if err != nil {
+		return nil, err
+	}
+	return s.ifaces, nil
+}
+
+func (a *addrInventory) byName(name string) (*ifaceAddrs, error) {
+	s, err := a.current()
+	if err != nil {
+		return nil, err
+	}
+	iface, ok := s.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("no such interface: %s", name)
+	}
+	return iface, nil
+}
+
+// byIP returns the name of the interface ip is assigned to, or "" if it is
+// not assigned to any.
+func (a *addrInventory) byIP(ip net.IP) (string, error) {
+	s, err := a.current()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range s.ifaces {
+		for _, ipnet := range iface.addrs {
+			if ipnet.IP.Equal(ip) {
+				return iface.name, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// RunAddrInventory loads the interface addresses from netlink and keeps
+// them current until a subscription fails.
+func (p *proxy) RunAddrInventory() error {
+	addr := make(chan netlink.AddrUpdate)
+	link := make(chan netlink.LinkUpdate)
+	if err := netlink.AddrSubscribe(addr, nil); err != nil {
+		return err
+	}
+	if err := netlink.LinkSubscribe(link, nil); err != nil {
+		return err
+	}
+	for {
+		s, err := loadAddrSnapshot()
+		if err != nil {
+			return err
+		}
+		p.addrs.snapshot.Store(s)
+		select {
+		case _, ok := <-addr:
+			if !ok {
+				return errors.New("address subscription closed")
+			}
+		case _, ok := <-link:
+			if !ok {
+				return errors.New("link subscription closed")
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package maddrproxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAddrInventory(t *testing.T) {
+	lo, err := loopbackInterface()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	p := NewTestProxy(nil)
+	if s := p.addrs.snapshot.Load(); s != nil {
+		t.Fatal("expected no snapshot before the inventory runs")
+	}
+	// Before the first load, lookups fall back to the net package.
+	if name, err := p.addrs.byIP(net.ParseIP("127.0.0.1")); err != nil || name != lo {
+		t.Fatalf("expected %s, got %q (%v)", lo, name, err)
+	}
+
+	go p.RunAddrInventory()
+	deadline := time.Now().Add(5 * time.Second)
+	for p.addrs.snapshot.Load() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("inventory was not loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	iface, err := p.addrs.byName(lo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	netIface, err := net.InterfaceByName(lo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := netIface.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iface.index != netIface.Index || len(iface.addrs) != len(addrs) {
+		t.Fatalf("expected %d addresses on %s, got %v", len(addrs), lo, iface.addrs)
+	}
+	for _, a := range addrs {
+		found := false
+		for _, ipnet := range iface.addrs {
+			if ipnet.String() == a.String() {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("address %s of %s is missing", a, lo)
+		}
+	}
+	if name, err := p.addrs.byIP(net.ParseIP("127.0.0.1")); err != nil || name != lo {
+		t.Fatalf("expected %s, got %q (%v)", lo, name, err)
+	}
+	if _, err := p.addrs.byName("nonexistent0"); err == nil {
+		t.Fatal("expected error for unknown interface")
+	}
+}
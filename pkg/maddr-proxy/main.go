@@ -2,12 +2,16 @@ package maddrproxy
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"strings"
+	"net/url"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/hrntknr/maddr-proxy/pkg/utils"
@@ -15,121 +19,538 @@ import (
 )
 
 const timeout = 10 * time.Second
+const udpTimeout = 2 * time.Minute
 const proxyAuthHeaderKey = "Proxy-Authorization"
+const sourceHeaderKey = "X-Proxy-Source"
+const selectorHeaderKey = "X-Maddr-Source"
 
 type proxy struct {
-	passwords []string
+	verifier     utils.Verifier
+	identities   bool
+	bindDevice   bool
+	selectorKey  string
+	marks        map[string]uint32
+	egressDNS    bool
+	nameservers  map[string][]string
+	failover     int
+	health       *healthChecker
+	namespaces   *netnsCache
+	dns          *dnsCache
+	addrs        *addrInventory
+	udpTimeout   time.Duration
+	pool         *connPool
+	clientCAs    *x509.CertPool
+	certPolicies map[string]*egressPolicy
+	userPolicies map[string]*egressPolicy
+	dest         *destPolicy
+	sources      *sourcePool
+	leases       *leaseTable
 }
 
 func NewProxy(passwords []string) *proxy {
 	p := &proxy{
-		passwords: passwords,
+		udpTimeout:  udpTimeout,
+		selectorKey: selectorHeaderKey,
+		pool:        newConnPool(poolMaxIdle, poolMaxIdlePerHost, 0, poolIdleTimeout),
 	}
+	if len(passwords) > 0 {
+		p.verifier = utils.Passwords(passwords)
+	}
+	p.dest, _ = newDestPolicy(nil, true)
+	p.sources = newSourcePool(strategyRandom)
+	p.leases = newLeaseTable(sessionTTL)
+	p.namespaces = newNetnsCache(netnsDir)
+	p.dns = newDNSCache(dnsCacheSize)
+	p.addrs = newAddrInventory()
 
 	return p
 }
 
-func (p *proxy) resolveIface(hint string, iface *net.Interface, target string) (net.Addr, string, error) {
+func (p *proxy) SetCredentialFile(path string) error {
+	htpasswd, err := utils.NewHtpasswd(path)
+	if err != nil {
+		return err
+	}
+	p.verifier, p.identities = htpasswd, true
+	return nil
+}
+
+func (p *proxy) SetDestinationRules(rules []string, defaults bool) error {
+	dest, err := newDestPolicy(rules, defaults)
+	if err != nil {
+		return err
+	}
+	p.dest = dest
+	return nil
+}
+
+func (p *proxy) SetPoolStrategy(strategy string) error {
+	if err := validateStrategy(strategy); err != nil {
+		return err
+	}
+	p.sources = newSourcePool(strategy)
+	return nil
+}
+
+func (p *proxy) SetSessionTTL(ttl time.Duration) {
+	p.leases = newLeaseTable(ttl)
+}
+
+func (p *proxy) SetUserPolicies(policies []string) error {
+	userPolicies, err := parsePolicies(policies)
+	if err != nil {
+		return err
+	}
+	p.userPolicies = userPolicies
+	return nil
+}
+
+func (p *proxy) SetClientCA(caFile string, policies []string) error {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in %s", caFile)
+	}
+	certPolicies, err := parsePolicies(policies)
+	if err != nil {
+		return err
+	}
+	p.clientCAs, p.certPolicies = pool, certPolicies
+	return nil
+}
+
+func (p *proxy) SetPool(maxIdle int, maxIdlePerHost int, maxConnsPerHost int, idleTimeout time.Duration) {
+	p.pool = newConnPool(maxIdle, maxIdlePerHost, maxConnsPerHost, idleTimeout)
+}
+
+// SetBindDevice makes interface selectors bind the outbound socket to the
+// interface with SO_BINDTODEVICE, so that they work without the policy
+// routing installed by setup-route and on interfaces without a usable
+// address.
+func (p *proxy) SetBindDevice(bindDevice bool) {
+	p.bindDevice = bindDevice
+}
+
+// SetFailover enables retrying a failed dial from up to n other addresses
+// of the same pool or interface. The source that was used is reported in
+// the X-Proxy-Source response header.
+func (p *proxy) SetFailover(n int) {
+	p.failover = n
+}
+
+func (p *proxy) SetMarks(marks []string) error {
+	m, err := parseMarks(marks)
+	if err != nil {
+		return err
+	}
+	p.marks = m
+	return nil
+}
+
+// SetSelectorHeader sets the request header that may carry a source
+// selector in place of the one in the user name. An empty name disables it.
+func (p *proxy) SetSelectorHeader(name string) {
+	p.selectorKey = http.CanonicalHeaderKey(name)
+}
+
+func (p *proxy) SetUDPTimeout(d time.Duration) {
+	p.udpTimeout = d
+}
+
+func ipFamilies(ips []net.IP) (bool, bool) {
+	hasIPv4, hasIPv6 := false, false
+	for _, ip := range ips {
+		if ip.To4() == nil {
+			hasIPv6 = true
+		} else {
+			hasIPv4 = true
+		}
+	}
+	return hasIPv4, hasIPv6
+}
+
+// resolveTarget resolves the host of target as src would. Selectors keep
+// the result on the sources whose family it decided, and dialing them
+// uses it instead of resolving the name again.
+func (p *proxy) resolveTarget(src *source, target string) ([]net.IP, error) {
 	host, _, err := net.SplitHostPort(target)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
-	hosts, err := net.LookupHost(host)
+	return p.lookupHost(context.Background(), src, host)
+}
+
+func (p *proxy) resolveIface(hint string, iface *ifaceAddrs, target string) (*source, error) {
+	targetIPs, err := p.resolveTarget(ifaceSource(iface.name, p.bindDevice), target)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
-	targetHasIPv4, targetHasIPv6 := false, false
-	for _, h := range hosts {
-		if ip := net.ParseIP(h); ip != nil {
-			if ip.To4() == nil {
-				targetHasIPv6 = true
-			} else {
-				targetHasIPv4 = true
+	targetHasIPv4, targetHasIPv6 := ipFamilies(targetIPs)
+
+	// The first address of the preferred family is used, the remaining
+	// ones are kept as fallbacks for failover. Without a family hint the
+	// first address of the other family races it (Happy Eyeballs).
+	families := [][]*source{}
+	for _, family := range []struct {
+		network string
+		valid   func(net.IP) bool
+		ok      bool
+	}{
+		{network: "tcp6", valid: utils.IsValidIPv6, ok: targetHasIPv6 && (hint == "tcp6" || hint == "tcp")},
+		{network: "tcp4", valid: utils.IsValidIPv4, ok: targetHasIPv4 && (hint == "tcp4" || hint == "tcp")},
+	} {
+		if !family.ok {
+			continue
+		}
+		sources := []*source{}
+		for _, ipnet := range iface.addrs {
+			if family.valid(ipnet.IP) {
+				src := newSource(ipnet.IP, family.network)
+				src.iface = iface.name
+				sources = append(sources, src)
 			}
 		}
+		if len(sources) > 0 {
+			families = append(families, sources)
+		}
+	}
+	var src *source
+	if len(families) > 0 {
+		src = families[0][0]
+		src.fallbacks = families[0][1:]
+		if len(families) > 1 {
+			src.eyeballs = families[1][0]
+		}
+	}
+	if src != nil {
+		src.setTargetIPs(targetIPs)
+	}
+	if !p.bindDevice {
+		if src == nil {
+			return nil, errors.New("no suitable address found")
+		}
+		return src, nil
 	}
 
-	addrs, err := iface.Addrs()
+	// Bound to the device, the kernel picks the source address itself, so
+	// an interface without a usable address is still selectable.
+	if src == nil {
+		if hint == "tcp4" && !targetHasIPv4 || hint == "tcp6" && !targetHasIPv6 {
+			return nil, fmt.Errorf("no %s address found for %s", hint, target)
+		}
+		src = &source{network: hint, iface: iface.name, targetIPs: targetIPs}
+	}
+	src.device = iface.name
+	for _, f := range src.fallbacks {
+		f.device = iface.name
+	}
+	if src.eyeballs != nil {
+		src.eyeballs.device = iface.name
+	}
+	return src, nil
+}
+
+func (p *proxy) resolve(target string, pr *principal) (*source, error) {
+	sel, err := parseSelection(pr.user)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
-	for _, a := range addrs {
-		if ipnet, ok := a.(*net.IPNet); ok && utils.IsValidIPv6(ipnet.IP) && targetHasIPv6 && (hint == "tcp6" || hint == "tcp") {
-			return &net.TCPAddr{IP: ipnet.IP, Port: 0}, "tcp6", nil
+	switch {
+	case sel.addr != nil:
+		return newSource(sel.addr, addrNetwork(sel.addr)), nil
+	case sel.pool != nil:
+		return p.resolvePool(sel.hint, sel.pool, target, pr)
+	case sel.prefix != "":
+		return p.resolvePrefix(sel.hint, sel.prefix)
+	case sel.mark != "":
+		return p.resolveMark(sel.hint, sel.mark)
+	case sel.netns != "":
+		return p.resolveNetns(sel.hint, sel.netns)
+	case sel.vrf != "":
+		return p.resolveVrf(sel.hint, sel.vrf)
+	case sel.iface != "":
+		iface, err := p.addrs.byName(sel.iface)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find interface: %w", err)
 		}
+		return p.resolveIface(sel.hint, iface, target)
+	}
+	return &source{network: sel.hint}, nil
+}
+
+func (p *proxy) selectSource(host string, pr *principal) (*source, error) {
+	src, err := p.resolve(host, pr)
+	if err != nil {
+		return nil, err
 	}
-	for _, a := range addrs {
-		if ipnet, ok := a.(*net.IPNet); ok && utils.IsValidIPv4(ipnet.IP) && targetHasIPv4 && (hint == "tcp4" || hint == "tcp") {
-			return &net.TCPAddr{IP: ipnet.IP, Port: 0}, "tcp4", nil
+	if err := p.checkSource(src, pr); err != nil {
+		return nil, err
+	}
+	if src.eyeballs != nil && p.checkSource(src.eyeballs, pr) != nil {
+		src.eyeballs = nil
+	}
+	return src, nil
+}
+
+func (p *proxy) checkSource(src *source, pr *principal) error {
+	if err := pr.policy.check(src, p.addrs); err != nil {
+		if pr.name != "" {
+			return &policyError{fmt.Errorf("%s: %w", pr.name, err)}
 		}
+		return err
 	}
-	return nil, "", errors.New("no suitable address found")
+	return nil
 }
 
-func (p *proxy) resolve(target string, user string) (net.Addr, string, error) {
-	if user != "" {
-		if ip := net.ParseIP(user); ip != nil {
-			addr := &net.TCPAddr{
-				IP:   ip,
-				Port: 0,
-			}
-			if ip.To4() == nil {
-				return addr, "tcp6", nil
-			} else {
-				return addr, "tcp4", nil
-			}
-		} else {
-			ifaceName := user
-			hint := "tcp"
-			if index := strings.Index(user, ":"); index != -1 {
-				hint = user[:index]
-				ifaceName = user[index+1:]
-				if hint != "tcp" && hint != "tcp4" && hint != "tcp6" {
-					return nil, "", fmt.Errorf("invalid hint: %s", hint)
-				}
-			}
-			iface, err := net.InterfaceByName(ifaceName)
-			if err != nil {
-				return nil, "", fmt.Errorf("failed to find interface: %w", err)
-			}
-			return p.resolveIface(hint, iface, target)
+func (p *proxy) lookupTarget(ctx context.Context, src *source, target string) ([]net.IP, string, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, "", err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, "", err
+	}
+	ips := src.targetIPs
+	if ips == nil {
+		ips, err = p.lookupHost(ctx, src, host)
+		if err != nil {
+			return nil, "", err
 		}
 	}
-	return nil, "tcp", nil
+	if err := p.dest.check(host, port, ips); err != nil {
+		return nil, "", err
+	}
+	return ips, portStr, nil
 }
 
-func (p *proxy) handleConn(req *http.Request, user string, conn net.Conn) (net.Conn, error) {
-	host := p.formatHostPort(req.URL.Host, 443)
-	addr, network, err := p.resolve(host, user)
+func matchFamily(network string, ip net.IP) bool {
+	switch network {
+	case "tcp4", "udp4":
+		return ip.To4() != nil
+	case "tcp6", "udp6":
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// dialTarget dials only the addresses that passed the destination policy,
+// so that the name cannot be resolved to a different address in between.
+// It returns the source that was used, which differs from src when the
+// other family of src won the Happy Eyeballs race.
+func (p *proxy) dialTarget(ctx context.Context, src *source, target string) (net.Conn, *source, error) {
+	ips, port, err := p.lookupTarget(ctx, src, target)
+	if err != nil {
+		return nil, nil, err
+	}
+	if src.eyeballs != nil {
+		if attempts := eyeballsAttempts(src, ips, port); len(attempts) > 0 {
+			return p.raceDial(ctx, attempts)
+		}
+	}
+	err = fmt.Errorf("no %s address found for %s", src.network, target)
+	for _, ip := range ips {
+		if !matchFamily(src.network, ip) {
+			continue
+		}
+		conn, dialErr := p.dialAddr(ctx, src, net.JoinHostPort(ip.String(), port))
+		if dialErr == nil {
+			return conn, src, nil
+		}
+		err = dialErr
+	}
+	return nil, nil, err
+}
+
+func (p *proxy) dialAddr(ctx context.Context, src *source, addr string) (net.Conn, error) {
+	dial := p.namespaces.dialContext(src.netns, utils.GetDialContext(timeout, src.addr, src.options()...))
+	conn, err := dial(ctx, src.network, addr)
 	if err != nil {
 		return nil, err
 	}
-	peer, err := utils.GetDialContext(timeout, addr)(context.Background(), network, host)
+	if ip := src.ip(); ip != nil {
+		return p.sources.track(conn, ip), nil
+	}
+	return conn, nil
+}
+
+// dialFailover dials src, and when that fails with an error that points
+// at a dead uplink, up to p.failover of its fallbacks in turn. It returns
+// the source that was finally used.
+func (p *proxy) dialFailover(ctx context.Context, src *source, host string, pr *principal) (net.Conn, *source, error) {
+	conn, used, err := p.dialTarget(ctx, src, host)
+	for i := 0; err != nil && i < p.failover && i < len(src.fallbacks) && isFailoverError(err); i++ {
+		next := src.fallbacks[i]
+		if p.checkSource(next, pr) != nil {
+			continue
+		}
+		conn, used, err = p.dialTarget(ctx, next, host)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, used, nil
+}
+
+func (p *proxy) dial(host string, pr *principal) (net.Conn, *source, error) {
+	src, err := p.selectSource(host, pr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p.dialFailover(context.Background(), src, host, pr)
+}
+
+func (p *proxy) handleConn(req *http.Request, pr *principal, conn net.Conn) (net.Conn, error) {
+	host := p.formatHostPort(req.URL.Host, 443)
+	peer, src, err := p.dial(host, pr)
 	if err != nil {
 		return nil, err
 	}
 
-	utils.WriteHttpResponseConn(conn, http.StatusOK, "Connection established", nil)
+	var header http.Header
+	if p.failover > 0 {
+		header = http.Header{sourceHeaderKey: []string{src.String()}}
+	}
+	utils.WriteHttpResponseConn(conn, http.StatusOK, "Connection established", header)
 	return peer, nil
 }
 
-func (p *proxy) handleReq(req *http.Request, user string) (net.Conn, error) {
-	host := p.formatHostPort(req.Host, 80)
-	addr, network, err := p.resolve(host, user)
+func (p *proxy) roundTrip(req *http.Request, host string, pr *principal) (*http.Response, *poolConn, *source, error) {
+	src, err := p.selectSource(host, pr)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
+	}
+	key := newPoolKey(src, host)
+
+	for {
+		pc, err := p.pool.acquire(req.Context(), key)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		reused := pc != nil
+		used := src
+		if !reused {
+			var peer net.Conn
+			peer, used, err = p.dialFailover(req.Context(), src, host, pr)
+			if err != nil {
+				p.pool.release(key)
+				return nil, nil, nil, err
+			}
+			usedKey := newPoolKey(used, host)
+			if usedKey != key {
+				p.pool.move(key, usedKey)
+			}
+			pc = p.pool.wrap(peer, usedKey)
+		}
+
+		resp, written, err := p.exchange(pc, req)
+		if err != nil {
+			pc.Close()
+			// An idle connection may have been closed by the peer in the
+			// meantime, so retry on a fresh one when that cannot repeat
+			// the request.
+			if reused && replayable(req, written) {
+				continue
+			}
+			return nil, nil, nil, err
+		}
+		return resp, pc, used, nil
+	}
+}
+
+// replayable tells whether a request that failed may be sent again: its
+// body was not consumed, and either the peer saw none of it or it is
+// idempotent.
+func replayable(req *http.Request, written bool) bool {
+	if req.Body != http.NoBody {
+		return false
+	}
+	if !written {
+		return true
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// exchange sends req on pc and reads its final response. It also reports
+// whether any of the request was written, even when it fails.
+func (p *proxy) exchange(pc *poolConn, req *http.Request) (*http.Response, bool, error) {
+	cw := &countWriter{w: pc}
+	if err := req.Write(cw); err != nil {
+		return nil, cw.n > 0, err
+	}
+	for {
+		resp, err := http.ReadResponse(pc.br, req)
+		if err != nil {
+			return nil, true, err
+		}
+		if resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, true, nil
+		}
+	}
+}
+
+func (p *proxy) handleReq(w http.ResponseWriter, req *http.Request, pr *principal) error {
+	host := p.formatHostPort(req.Host, 80)
+
+	outreq := req.Clone(req.Context())
+	utils.RemoveHopHeaders(outreq.Header)
+	if p.selectorKey != "" {
+		outreq.Header.Del(p.selectorKey)
 	}
-	peer, err := utils.GetDialContext(timeout, addr)(context.Background(), network, host)
+	outreq.URL = &url.URL{Path: req.URL.Path, RawPath: req.URL.RawPath, RawQuery: req.URL.RawQuery}
+	outreq.RequestURI = ""
+	outreq.Close = false
+
+	resp, pc, src, err := p.roundTrip(outreq, host, pr)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if err = req.Write(peer); err != nil {
-		peer.Close()
-		return nil, err
+	utils.RemoveHopHeaders(resp.Header)
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	if p.failover > 0 {
+		w.Header().Set(sourceHeaderKey, src.String())
+	}
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", resp.ContentLength))
 	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		resp.Body.Close()
+		pc.Close()
+		// Abort so that the client does not mistake a truncated body
+		// for a complete response.
+		panic(http.ErrAbortHandler)
+	}
+	resp.Body.Close()
 
-	return peer, nil
+	if resp.Close {
+		pc.Close()
+	} else {
+		p.pool.put(pc)
+	}
+	return nil
 }
 
 func (p *proxy) formatHostPort(hostStr string, defaultPort uint16) string {
@@ -141,45 +562,43 @@ func (p *proxy) formatHostPort(hostStr string, defaultPort uint16) string {
 }
 
 func (p *proxy) serve(w http.ResponseWriter, req *http.Request) {
+	pr, code, err := p.authenticate(req)
+	if err != nil {
+		if code == http.StatusProxyAuthRequired {
+			w.Header().Set("Proxy-Authenticate", "Basic realm=\"Proxy\"")
+		}
+		utils.WriteHttpError(w, code, err)
+		return
+	}
+
+	if req.Method != http.MethodConnect {
+		if err := p.handleReq(w, req, pr); err != nil {
+			utils.WriteHttpError(w, errorStatus(err), err)
+		}
+		return
+	}
+
 	conn, wr, err := w.(http.Hijacker).Hijack()
 	if err != nil {
-		utils.WriteHttpResponse(wr, http.StatusInternalServerError, "", http.Header{"X-Proxy-Error": []string{err.Error()}})
+		utils.WriteHttpError(w, http.StatusInternalServerError, err)
 		return
 	}
 	defer conn.Close()
 
-	user, code, err := utils.ProxyAuthenticate(proxyAuthHeaderKey, p.passwords, req)
+	peer, err := p.handleConn(req, pr, conn)
 	if err != nil {
-		h := http.Header{"X-Proxy-Error": []string{err.Error()}}
-		if code == http.StatusProxyAuthRequired {
-			h.Set("Proxy-Authenticate", "Basic realm=\"Proxy\"")
-		}
-		utils.WriteHttpResponse(wr, code, "", h)
+		utils.WriteHttpResponse(wr, errorStatus(err), "", http.Header{"X-Proxy-Error": []string{err.Error()}})
 		return
 	}
+	defer peer.Close()
 
-	var peer net.Conn
-	switch req.Method {
-	case http.MethodConnect:
-		_peer, err := p.handleConn(req, user, conn)
-		if err != nil {
-			utils.WriteHttpResponse(wr, http.StatusInternalServerError, "", http.Header{"X-Proxy-Error": []string{err.Error()}})
-			return
-		}
-		peer = _peer
-	case http.MethodGet:
-		_peer, err := p.handleReq(req, user)
-		if err != nil {
-			utils.WriteHttpResponse(wr, http.StatusInternalServerError, "", http.Header{"X-Proxy-Error": []string{err.Error()}})
-			return
-		}
-		peer = _peer
-	default:
-		utils.WriteHttpResponse(wr, http.StatusMethodNotAllowed, "", nil)
+	if err := relay(conn, peer); err != nil {
+		utils.WriteHttpResponse(wr, http.StatusMethodNotAllowed, "", http.Header{"X-Proxy-Error": []string{err.Error()}})
 		return
 	}
-	defer peer.Close()
+}
 
+func relay(conn net.Conn, peer net.Conn) error {
 	wg := &errgroup.Group{}
 	wg.Go(func() error {
 		if _, err := io.Copy(conn, peer); err != nil {
@@ -195,17 +614,50 @@ func (p *proxy) serve(w http.ResponseWriter, req *http.Request) {
 		peer.Close()
 		return nil
 	})
-	if err := wg.Wait(); err != nil {
-		utils.WriteHttpResponse(wr, http.StatusMethodNotAllowed, "", http.Header{"X-Proxy-Error": []string{err.Error()}})
-		return
-	}
+	return wg.Wait()
 }
 
-func (p *proxy) ListenAndServe(addr string) error {
-	server := &http.Server{
+func (p *proxy) newServer(addr string) *http.Server {
+	return &http.Server{
 		Addr:    addr,
 		Handler: http.HandlerFunc(p.serve),
+		// CONNECT relies on hijacking, which HTTP/2 does not support.
+		TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){},
+	}
+}
+
+// errClientCANeedsTLS is returned by the listeners that cannot verify
+// client certificates, so that a client CA never leaves them open.
+var errClientCANeedsTLS = errors.New("client certificates require the TLS listener")
+
+func (p *proxy) ListenAndServe(addr string) error {
+	if p.clientCAs != nil {
+		return errClientCANeedsTLS
+	}
+	return p.newServer(addr).ListenAndServe()
+}
+
+func (p *proxy) newTLSServer(addr string, certFile string, keyFile string) (*http.Server, error) {
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	server := p.newServer(addr)
+	server.TLSConfig = &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+	}
+	if p.clientCAs != nil {
+		server.TLSConfig.ClientCAs = p.clientCAs
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return server, nil
+}
+
+func (p *proxy) ListenAndServeTLS(addr string, certFile string, keyFile string) error {
+	server, err := p.newTLSServer(addr, certFile, keyFile)
+	if err != nil {
+		return err
 	}
 
-	return server.ListenAndServe()
+	return server.ListenAndServeTLS("", "")
 }
@@ -1,9 +1,15 @@
 package maddrproxy
 
 import (
+	"bufio"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
 	"net/url"
+	"strings"
+	"sync/atomic"
 	"testing"
 )
 
@@ -11,7 +17,7 @@ func TestHttpsProxy(t *testing.T) {
 	dummyServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	}))
-	proxy := NewProxy([]string{})
+	proxy := NewTestProxy([]string{})
 	resp, err := NewProxyClient(proxy, nil).Get(dummyServer.URL)
 	if err != nil {
 		t.Fatal(err)
@@ -60,7 +66,7 @@ func TestHttpProxy(t *testing.T) {
 			dummyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(http.StatusOK)
 			}))
-			proxy := NewProxy(tc.auth)
+			proxy := NewTestProxy(tc.auth)
 			u, _ := url.Parse(dummyServer.URL)
 			resp, err := NewProxyClient(proxy, tc.urlModifyFunc).Do(&http.Request{
 				Method: http.MethodGet,
@@ -76,3 +82,163 @@ func TestHttpProxy(t *testing.T) {
 		})
 	}
 }
+
+func TestHttpProxyMethods(t *testing.T) {
+	dummyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(proxyAuthHeaderKey) != "" || r.Header.Get("X-Hop") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Method", r.Method)
+		w.WriteHeader(http.StatusOK)
+		io.Copy(w, r.Body)
+	}))
+	defer dummyServer.Close()
+	client := NewProxyClient(NewTestProxy([]string{}), func(u *url.URL) {
+		u.User = url.UserPassword("", "")
+	})
+	for _, method := range []string{
+		http.MethodGet,
+		http.MethodHead,
+		http.MethodPost,
+		http.MethodPut,
+		http.MethodPatch,
+		http.MethodDelete,
+		http.MethodOptions,
+	} {
+		t.Run(method, func(t *testing.T) {
+			req, err := http.NewRequest(method, dummyServer.URL+"/path?query", strings.NewReader("body"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Connection", "X-Hop")
+			req.Header.Set("X-Hop", "value")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+			if resp.Header.Get("X-Method") != method {
+				t.Fatalf("expected method %s, got %s", method, resp.Header.Get("X-Method"))
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if method != http.MethodHead && string(body) != "body" {
+				t.Fatalf("expected body %q, got %q", "body", body)
+			}
+		})
+	}
+}
+
+func TestHttpProxyKeepAlive(t *testing.T) {
+	newServer := func(name string, conns *atomic.Int32) *httptest.Server {
+		s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		s.Config.ConnState = func(c net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				conns.Add(1)
+			}
+		}
+		s.Start()
+		return s
+	}
+	var connsA, connsB atomic.Int32
+	serverA := newServer("a", &connsA)
+	defer serverA.Close()
+	serverB := newServer("b", &connsB)
+	defer serverB.Close()
+
+	client := NewProxyClient(NewTestProxy([]string{}), nil)
+	for i, tc := range []struct {
+		url      string
+		expected string
+	}{
+		{url: serverA.URL, expected: "a"},
+		{url: serverB.URL, expected: "b"},
+		{url: serverA.URL, expected: "a"},
+		{url: serverB.URL, expected: "b"},
+	} {
+		reused := false
+		req, _ := http.NewRequest(http.MethodGet, tc.url, nil)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+		}))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != tc.expected {
+			t.Fatalf("request %d: expected body %q, got %q", i, tc.expected, body)
+		}
+		if i > 0 && !reused {
+			t.Fatalf("request %d: expected proxy connection to be reused", i)
+		}
+	}
+	if connsA.Load() != 1 || connsB.Load() != 1 {
+		t.Fatalf("expected one upstream connection per host, got %d and %d", connsA.Load(), connsB.Load())
+	}
+}
+
+func TestHttpProxyNoReplay(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// The upstream answers GETs and drops the connection after reading a
+	// POST, as if it had closed the idle connection meanwhile.
+	var posts atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					if req.Method == http.MethodPost {
+						posts.Add(1)
+						return
+					}
+					io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+				}
+			}()
+		}
+	}()
+
+	client := NewProxyClient(NewTestProxy([]string{}), nil)
+	target := "http://" + ln.Addr().String()
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = client.Post(target, "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected status %d, got %d", http.StatusInternalServerError, resp.StatusCode)
+	}
+	if posts.Load() != 1 {
+		t.Fatalf("expected the POST to be sent once, got %d", posts.Load())
+	}
+}
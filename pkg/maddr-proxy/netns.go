@@ -0,0 +1,140 @@
+package maddrproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hrntknr/maddr-proxy/pkg/utils"
+	"github.com/vishvananda/netns"
+)
+
+const netnsPrefix = "netns"
+const netnsDir = "/var/run/netns"
+
+type netnsEntry struct {
+	handle netns.NsHandle
+	dev    uint64
+	ino    uint64
+}
+
+// netnsCache keeps the named namespaces open between connections. An
+// entry is reopened when the file under dir now refers to a different
+// namespace, e.g. after "ip netns del" and "ip netns add".
+type netnsCache struct {
+	dir string
+
+	mu      sync.Mutex
+	entries map[string]*netnsEntry
+}
+
+type netnsInfo struct {
+	Name   string `json:"name"`
+	Cached bool   `json:"cached"`
+}
+
+func newNetnsCache(dir string) *netnsCache {
+	return &netnsCache{
+		dir:     dir,
+		entries: map[string]*netnsEntry{},
+	}
+}
+
+func (c *netnsCache) get(name string) (netns.NsHandle, error) {
+	if name == "" || strings.Contains(name, "/") || name == "." || name == ".." {
+		return netns.None(), fmt.Errorf("invalid netns: %q", name)
+	}
+	path := filepath.Join(c.dir, name)
+	fi, err := os.Stat(path)
+	if err != nil {
+		c.drop(name)
+		return netns.None(), fmt.Errorf("failed to find netns: %w", err)
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return netns.None(), errors.New("failed to stat netns")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[name]; ok {
+		if e.dev == uint64(st.Dev) && e.ino == st.Ino {
+			return e.handle, nil
+		}
+		e.handle.Close()
+		delete(c.entries, name)
+	}
+	handle, err := netns.GetFromPath(path)
+	if err != nil {
+		return netns.None(), fmt.Errorf("failed to open netns: %w", err)
+	}
+	c.entries[name] = &netnsEntry{handle: handle, dev: uint64(st.Dev), ino: st.Ino}
+	return handle, nil
+}
+
+func (c *netnsCache) drop(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[name]; ok {
+		e.handle.Close()
+		delete(c.entries, name)
+	}
+}
+
+func (c *netnsCache) list() ([]netnsInfo, error) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ret := []netnsInfo{}
+	for _, e := range entries {
+		_, cached := c.entries[e.Name()]
+		ret = append(ret, netnsInfo{Name: e.Name(), Cached: cached})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret, nil
+}
+
+// in runs fn inside the named namespace, or in the current one when name
+// is empty.
+func (c *netnsCache) in(name string, fn func() error) error {
+	if name == "" {
+		return fn()
+	}
+	handle, err := c.get(name)
+	if err != nil {
+		return err
+	}
+	return utils.InNetns(handle, fn)
+}
+
+func (c *netnsCache) dialContext(name string, dial func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		var conn net.Conn
+		err := c.in(name, func() error {
+			var err error
+			conn, err = dial(ctx, network, address)
+			return err
+		})
+		return conn, err
+	}
+}
+
+// resolveNetns leaves the source address to the routing of the namespace.
+func (p *proxy) resolveNetns(hint string, name string) (*source, error) {
+	if _, err := p.namespaces.get(name); err != nil {
+		return nil, err
+	}
+	return &source{network: hint, netns: name}, nil
+}
@@ -0,0 +1,152 @@
+package maddrproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/hrntknr/maddr-proxy/pkg/utils"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+func newTestNetns(t *testing.T) netns.NsHandle {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer origin.Close()
+	ns, err := netns.New()
+	if err != nil {
+		t.Skip(err)
+	}
+	if err := netns.Set(origin); err != nil {
+		t.Fatal(err)
+	}
+	return ns
+}
+
+func TestNetns(t *testing.T) {
+	ns := newTestNetns(t)
+	defer ns.Close()
+
+	dir := t.TempDir()
+	if err := os.Symlink(fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), ns), filepath.Join(dir, "isp1")); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	p := NewTestProxy(nil)
+	p.namespaces = newNetnsCache(dir)
+	if _, err := p.resolve(ln.Addr().String(), &principal{user: "netns:isp2"}); err == nil {
+		t.Fatal("expected error for unknown netns")
+	}
+
+	// The listener lives in the proxy's namespace, so it must not be
+	// reachable from the fresh namespace, whose loopback is down.
+	if conn, _, err := p.dial(ln.Addr().String(), &principal{user: "netns:isp1"}); err == nil {
+		conn.Close()
+		t.Fatal("expected dial from netns to fail")
+	}
+	conn, _, err := p.dial(ln.Addr().String(), &principal{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	namespaces, err := p.namespaces.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(namespaces) != 1 || namespaces[0].Name != "isp1" || !namespaces[0].Cached {
+		t.Fatalf("unexpected namespaces %+v", namespaces)
+	}
+}
+
+func TestResolveVrf(t *testing.T) {
+	p := NewTestProxy(nil)
+	if lo, err := loopbackInterface(); err == nil {
+		if _, err := p.resolve("127.0.0.1:80", &principal{user: "vrf:" + lo}); err == nil {
+			t.Fatal("expected error for a non-vrf device")
+		}
+	}
+
+	ns := newTestNetns(t)
+	defer ns.Close()
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+	if err := handle.LinkAdd(&netlink.Vrf{LinkAttrs: netlink.LinkAttrs{Name: "vrf-blue"}, Table: 100}); err != nil {
+		t.Skip(err)
+	}
+
+	if err := utils.InNetns(ns, func() error {
+		src, err := p.resolve("127.0.0.1:80", &principal{user: "tcp4:vrf:vrf-blue"})
+		if err != nil {
+			return err
+		}
+		if src.device != "vrf-blue" || src.network != "tcp4" {
+			return fmt.Errorf("unexpected source %s %s", src.network, src.device)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnsureRouteExisting(t *testing.T) {
+	ns := newTestNetns(t)
+	defer ns.Close()
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+	link, err := handle.LinkByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handle.LinkSetUp(link); err != nil {
+		t.Skip(err)
+	}
+	// A default route installed by the administrator, as often found in
+	// VRF tables.
+	if err := handle.RouteAdd(&netlink.Route{
+		Dst:       getDefaultRoute(netlink.FAMILY_V4),
+		LinkIndex: link.Attrs().Index,
+		Table:     100,
+		Protocol:  netlink.RouteProtocol(unix.RTPROT_STATIC),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := utils.InNetns(ns, func() error {
+		for i := 0; i < 2; i++ {
+			if err := ensureRoute(netlink.FAMILY_V4, 100, link.Attrs().Index, net.ParseIP("127.0.0.2"), false); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	routes, err := handle.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: 100}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || routes[0].Protocol == iprouteProtocol {
+		t.Fatalf("expected only the existing default route, got %v", routes)
+	}
+}
@@ -0,0 +1,187 @@
+package maddrproxy
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+type policyError struct {
+	err error
+}
+
+func (e *policyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *policyError) Unwrap() error {
+	return e.err
+}
+
+type egressPolicy struct {
+	ifaces []*regexp.Regexp
+	nets   []*net.IPNet
+	marks  []string
+	netns  []string
+}
+
+func parseEgressPolicy(rules []string) (*egressPolicy, error) {
+	policy := &egressPolicy{}
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		if mark, ok := strings.CutPrefix(rule, markPrefix+":"); ok {
+			policy.marks = append(policy.marks, mark)
+			continue
+		}
+		if name, ok := strings.CutPrefix(rule, netnsPrefix+":"); ok {
+			policy.netns = append(policy.netns, name)
+			continue
+		}
+		if _, ipnet, err := net.ParseCIDR(rule); err == nil {
+			policy.nets = append(policy.nets, ipnet)
+			continue
+		}
+		if ip := net.ParseIP(rule); ip != nil {
+			mask := len(ip.To16()) * 8
+			if ip.To4() != nil {
+				ip, mask = ip.To4(), 32
+			}
+			policy.nets = append(policy.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(mask, mask)})
+			continue
+		}
+		re, err := regexp.Compile("^(?:" + rule + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid interface pattern %q: %w", rule, err)
+		}
+		policy.ifaces = append(policy.ifaces, re)
+	}
+	return policy, nil
+}
+
+func (e *egressPolicy) allows(ip net.IP, iface string) bool {
+	if e == nil {
+		return true
+	}
+	for _, ipnet := range e.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	for _, re := range e.ifaces {
+		if iface != "" && re.MatchString(iface) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *egressPolicy) check(src *source, addrs *addrInventory) error {
+	if e == nil {
+		return nil
+	}
+	if src.netns != "" {
+		for _, name := range e.netns {
+			if name == src.netns {
+				return nil
+			}
+		}
+		return &policyError{fmt.Errorf("netns %s is not allowed", src.netns)}
+	}
+	if src.mark != 0 {
+		return e.checkMark(src)
+	}
+	ip := src.ip()
+	if ip == nil && src.device == "" {
+		return &policyError{errors.New("source address must be selected explicitly")}
+	}
+	iface := src.device
+	if iface == "" && len(e.ifaces) > 0 {
+		name, err := addrs.byIP(ip)
+		if err != nil {
+			return err
+		}
+		iface = name
+	}
+	if !e.allows(ip, iface) {
+		if ip == nil {
+			return &policyError{fmt.Errorf("source device %s is not allowed", iface)}
+		}
+		return &policyError{fmt.Errorf("source address %s is not allowed", ip)}
+	}
+	return nil
+}
+
+func (e *egressPolicy) checkMark(src *source) error {
+	for _, m := range e.marks {
+		if m == src.markName {
+			return nil
+		}
+		if mark, err := parseMark(m); err == nil && mark == src.mark {
+			return nil
+		}
+	}
+	return &policyError{fmt.Errorf("mark %s is not allowed", src.markName)}
+}
+
+const defaultPolicyName = "*"
+
+func parsePolicies(policies []string) (map[string]*egressPolicy, error) {
+	ret := map[string]*egressPolicy{}
+	for _, p := range policies {
+		i := strings.Index(p, "=")
+		if i == -1 {
+			return nil, fmt.Errorf("invalid policy: %s", p)
+		}
+		policy, err := parseEgressPolicy(strings.Split(p[i+1:], ","))
+		if err != nil {
+			return nil, err
+		}
+		ret[p[:i]] = policy
+	}
+	return ret, nil
+}
+
+func lookupPolicy(policies map[string]*egressPolicy, name string) *egressPolicy {
+	if policy, ok := policies[name]; ok {
+		return policy
+	}
+	return policies[defaultPolicyName]
+}
+
+func certIdentities(cert *x509.Certificate) []string {
+	ids := []string{}
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	ids = append(ids, cert.DNSNames...)
+	ids = append(ids, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		ids = append(ids, uri.String())
+	}
+	return ids
+}
+
+// lookupCertPolicy returns the first identity of cert with a policy, or
+// the * policy under the first identity of cert.
+func lookupCertPolicy(policies map[string]*egressPolicy, cert *x509.Certificate) (string, *egressPolicy, error) {
+	ids := certIdentities(cert)
+	for _, id := range ids {
+		if policy, ok := policies[id]; ok {
+			return id, policy, nil
+		}
+	}
+	if policy, ok := policies[defaultPolicyName]; ok {
+		name := cert.Subject.String()
+		if len(ids) > 0 {
+			name = ids[0]
+		}
+		return name, policy, nil
+	}
+	return "", nil, &policyError{fmt.Errorf("no policy for client certificate %q", cert.Subject.String())}
+}
@@ -0,0 +1,259 @@
+package maddrproxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const poolMaxIdle = 1024
+const poolMaxIdlePerHost = 16
+const poolIdleTimeout = 90 * time.Second
+
+type poolKey struct {
+	laddr   string
+	device  string
+	mark    uint32
+	netns   string
+	network string
+	host    string
+}
+
+type poolConn struct {
+	net.Conn
+	key  poolKey
+	br   *bufio.Reader
+	pool *connPool
+
+	timer *time.Timer
+	once  sync.Once
+}
+
+func (pc *poolConn) Close() error {
+	err := pc.Conn.Close()
+	pc.once.Do(func() {
+		pc.pool.release(pc.key)
+	})
+	return err
+}
+
+type poolStats struct {
+	Dials   uint64          `json:"dials"`
+	Reuses  uint64          `json:"reuses"`
+	Waits   uint64          `json:"waits"`
+	Expired uint64          `json:"expired"`
+	Idle    int             `json:"idle"`
+	Active  int             `json:"active"`
+	Hosts   []poolHostStats `json:"hosts"`
+}
+
+type poolHostStats struct {
+	Local   string `json:"local"`
+	Device  string `json:"device,omitempty"`
+	Mark    uint32 `json:"mark,omitempty"`
+	Netns   string `json:"netns,omitempty"`
+	Network string `json:"network"`
+	Host    string `json:"host"`
+	Idle    int    `json:"idle"`
+	Active  int    `json:"active"`
+}
+
+type connPool struct {
+	maxIdle         int
+	maxIdlePerHost  int
+	maxConnsPerHost int
+	idleTimeout     time.Duration
+
+	mu        sync.Mutex
+	idle      map[poolKey][]*poolConn
+	idleCount int
+	conns     map[poolKey]int
+	waiters   map[poolKey][]chan struct{}
+
+	dials   uint64
+	reuses  uint64
+	waits   uint64
+	expired uint64
+}
+
+func newConnPool(maxIdle int, maxIdlePerHost int, maxConnsPerHost int, idleTimeout time.Duration) *connPool {
+	return &connPool{
+		maxIdle:         maxIdle,
+		maxIdlePerHost:  maxIdlePerHost,
+		maxConnsPerHost: maxConnsPerHost,
+		idleTimeout:     idleTimeout,
+		idle:            map[poolKey][]*poolConn{},
+		conns:           map[poolKey]int{},
+		waiters:         map[poolKey][]chan struct{}{},
+	}
+}
+
+// newPoolKey keys connections by their source. Addresses drawn from a
+// prefix share the key of the prefix, as every request draws a new one.
+func newPoolKey(src *source, host string) poolKey {
+	key := poolKey{device: src.device, mark: src.mark, netns: src.netns, network: src.network, host: host}
+	if src.prefix != "" {
+		key.laddr = src.prefix
+	} else if src.addr != nil {
+		key.laddr = src.addr.String()
+	}
+	return key
+}
+
+// acquire returns an idle connection for key, or nil when the caller
+// should dial a new one. In the latter case a slot has been reserved and
+// must be given back with release if dialing fails.
+func (c *connPool) acquire(ctx context.Context, key poolKey) (*poolConn, error) {
+	for {
+		c.mu.Lock()
+		if pc := c.popIdle(key); pc != nil {
+			c.reuses++
+			c.mu.Unlock()
+			return pc, nil
+		}
+		if c.maxConnsPerHost <= 0 || c.conns[key] < c.maxConnsPerHost {
+			c.conns[key]++
+			c.dials++
+			c.mu.Unlock()
+			return nil, nil
+		}
+		ch := make(chan struct{})
+		c.waiters[key] = append(c.waiters[key], ch)
+		c.waits++
+		c.mu.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *connPool) popIdle(key poolKey) *poolConn {
+	for {
+		conns := c.idle[key]
+		if len(conns) == 0 {
+			return nil
+		}
+		pc := conns[len(conns)-1]
+		c.removeIdle(key, len(conns)-1)
+		// A stopped timer means the connection is not being expired
+		// concurrently, so it is safe to hand out.
+		if pc.timer.Stop() {
+			return pc
+		}
+	}
+}
+
+func (c *connPool) removeIdle(key poolKey, i int) {
+	conns := c.idle[key]
+	conns = append(conns[:i], conns[i+1:]...)
+	if len(conns) == 0 {
+		delete(c.idle, key)
+	} else {
+		c.idle[key] = conns
+	}
+	c.idleCount--
+}
+
+func (c *connPool) put(pc *poolConn) {
+	c.mu.Lock()
+	if c.idleCount >= c.maxIdle || len(c.idle[pc.key]) >= c.maxIdlePerHost {
+		c.mu.Unlock()
+		pc.Close()
+		return
+	}
+	pc.timer = time.AfterFunc(c.idleTimeout, func() {
+		c.expire(pc)
+	})
+	c.idle[pc.key] = append(c.idle[pc.key], pc)
+	c.idleCount++
+	c.wake(pc.key)
+	c.mu.Unlock()
+}
+
+func (c *connPool) expire(pc *poolConn) {
+	c.mu.Lock()
+	for i, conn := range c.idle[pc.key] {
+		if conn == pc {
+			c.removeIdle(pc.key, i)
+			c.expired++
+			break
+		}
+	}
+	c.mu.Unlock()
+	pc.Close()
+}
+
+// move transfers a reserved slot to another key, for a connection that
+// ended up being dialed from a different source.
+func (c *connPool) move(from poolKey, to poolKey) {
+	c.mu.Lock()
+	c.conns[to]++
+	c.mu.Unlock()
+	c.release(from)
+}
+
+func (c *connPool) release(key poolKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns[key]--; c.conns[key] <= 0 {
+		delete(c.conns, key)
+	}
+	c.wake(key)
+}
+
+func (c *connPool) wake(key poolKey) {
+	for _, ch := range c.waiters[key] {
+		close(ch)
+	}
+	delete(c.waiters, key)
+}
+
+func (c *connPool) wrap(conn net.Conn, key poolKey) *poolConn {
+	return &poolConn{
+		Conn: conn,
+		key:  key,
+		br:   bufio.NewReader(conn),
+		pool: c,
+	}
+}
+
+func (c *connPool) stats() poolStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := poolStats{
+		Dials:   c.dials,
+		Reuses:  c.reuses,
+		Waits:   c.waits,
+		Expired: c.expired,
+		Idle:    c.idleCount,
+		Hosts:   []poolHostStats{},
+	}
+	for key, n := range c.conns {
+		idle := len(c.idle[key])
+		stats.Active += n - idle
+		stats.Hosts = append(stats.Hosts, poolHostStats{
+			Local:   key.laddr,
+			Device:  key.device,
+			Mark:    key.mark,
+			Netns:   key.netns,
+			Network: key.network,
+			Host:    key.host,
+			Idle:    idle,
+			Active:  n - idle,
+		})
+	}
+	sort.Slice(stats.Hosts, func(i, j int) bool {
+		a, b := stats.Hosts[i], stats.Hosts[j]
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		return a.Local < b.Local
+	})
+	return stats
+}
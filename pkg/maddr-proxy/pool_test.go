@@ -0,0 +1,73 @@
+package maddrproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestConnPool(t *testing.T) {
+	pool := newConnPool(poolMaxIdle, poolMaxIdlePerHost, 1, 50*time.Millisecond)
+	key := newPoolKey(&source{network: "tcp"}, "example.com:80")
+
+	pc, err := pool.acquire(context.Background(), key)
+	if err != nil || pc != nil {
+		t.Fatalf("expected a dial slot, got %v, %v", pc, err)
+	}
+	conn, _ := net.Pipe()
+	pc = pool.wrap(conn, key)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := pool.acquire(ctx, key); err == nil {
+		t.Fatal("expected per-host cap to block")
+	}
+
+	pool.put(pc)
+	reused, err := pool.acquire(context.Background(), key)
+	if err != nil || reused != pc {
+		t.Fatalf("expected idle connection to be reused, got %v, %v", reused, err)
+	}
+
+	pool.put(reused)
+	time.Sleep(100 * time.Millisecond)
+	stats := pool.stats()
+	if stats.Idle != 0 || stats.Active != 0 || stats.Expired != 1 {
+		t.Fatalf("expected idle connection to expire, got %+v", stats)
+	}
+	if stats.Dials != 1 || stats.Reuses != 1 || stats.Waits != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestConnPoolPrefix(t *testing.T) {
+	dummyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer dummyServer.Close()
+	p := NewTestProxy([]string{})
+	client := NewProxyClient(p, func(u *url.URL) {
+		u.User = url.UserPassword("prefix:127.0.0.0/8", "")
+	})
+	// Each request draws another address from the prefix, but they all
+	// share the pooled connections of the prefix.
+	for i := 0; i < 10; i++ {
+		resp, err := client.Get(dummyServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+	}
+	if stats := p.pool.stats(); stats.Dials != 1 || stats.Reuses != 9 || stats.Idle != 1 {
+		t.Fatalf("unexpected pool stats %+v", stats)
+	}
+}
@@ -0,0 +1,140 @@
+package maddrproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/hrntknr/maddr-proxy/pkg/utils"
+)
+
+const dnsPort = "53"
+
+// parseNameservers parses "iface=addr,addr" entries, where iface may be *
+// for interfaces without an entry of their own.
+func parseNameservers(nameservers []string) (map[string][]string, error) {
+	ret := map[string][]string{}
+	for _, n := range nameservers {
+		iface, addrs, found := strings.Cut(n, "=")
+		if !found || iface == "" {
+			return nil, fmt.Errorf("invalid nameserver: %s", n)
+		}
+		for _, addr := range strings.Split(addrs, ",") {
+			addr = strings.TrimSpace(addr)
+			if ip := net.ParseIP(addr); ip != nil {
+				addr = net.JoinHostPort(addr, dnsPort)
+			} else if _, _, err := net.SplitHostPort(addr); err != nil {
+				return nil, fmt.Errorf("invalid nameserver address: %s", addr)
+			}
+			ret[iface] = append(ret[iface], addr)
+		}
+	}
+	return ret, nil
+}
+
+// egressResolver sends DNS queries from the source they are made for, and
+// to the nameservers configured for its interface if there are any.
+type egressResolver struct {
+	p           *proxy
+	src         *source
+	iface       string
+	nameservers []string
+	next        atomic.Uint32
+}
+
+func (r *egressResolver) server(address string) string {
+	if len(r.nameservers) == 0 {
+		return address
+	}
+	i := r.next.Add(1) - 1
+	return r.nameservers[int(i)%len(r.nameservers)]
+}
+
+// localAddr binds the query to the source address if it has the family of
+// the nameserver, or else to an address of that family on the interface.
+func (r *egressResolver) localAddr(network string, server string) net.Addr {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	ipv4 := ip.To4() != nil
+	valid := utils.IsValidIPv6
+	if ipv4 {
+		valid = utils.IsValidIPv4
+	}
+	var local net.IP
+	if srcIP := r.src.ip(); srcIP != nil && (srcIP.To4() != nil) == ipv4 {
+		local = srcIP
+	} else if iface, err := r.p.addrs.byName(r.iface); err == nil {
+		for _, ipnet := range iface.addrs {
+			if valid(ipnet.IP) {
+				local = ipnet.IP
+				break
+			}
+		}
+	}
+	if local == nil {
+		return nil
+	}
+	if strings.HasPrefix(network, "udp") {
+		return &net.UDPAddr{IP: local, Port: 0}
+	}
+	return &net.TCPAddr{IP: local, Port: 0}
+}
+
+func (r *egressResolver) dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	server := r.server(address)
+	dial := utils.GetDialContext(timeout, r.localAddr(network, server), r.src.options()...)
+	return r.p.namespaces.dialContext(r.src.netns, dial)(ctx, network, server)
+}
+
+// dnsDialer returns how lookups made on behalf of src reach their
+// nameservers, and the scope in which their answers may be shared. A nil
+// dial means the system configuration, which is used unless --egress-dns
+// is set or nameservers are configured for the interface of src.
+func (p *proxy) dnsDialer(src *source) (string, dialFunc) {
+	if src == nil || !p.egressDNS && len(p.nameservers) == 0 {
+		return "", nil
+	}
+	iface := src.iface
+	if iface == "" {
+		iface = src.device
+	}
+	if iface == "" && src.ip() != nil {
+		iface, _ = p.addrs.byIP(src.ip())
+	}
+	nameservers, ok := p.nameservers[iface]
+	if !ok {
+		nameservers = p.nameservers[defaultPolicyName]
+	}
+	if !p.egressDNS && len(nameservers) == 0 {
+		return "", nil
+	}
+	r := &egressResolver{p: p, src: src, iface: iface, nameservers: nameservers}
+	return src.netns + "/" + iface, r.dial
+}
+
+// ifaceSource stands in for a source on iface to decide the family before
+// an address of iface has been chosen.
+func ifaceSource(iface string, device bool) *source {
+	src := &source{iface: iface}
+	if device {
+		src.device = iface
+	}
+	return src
+}
+
+func (p *proxy) SetEgressDNS(egressDNS bool, nameservers []string) error {
+	m, err := parseNameservers(nameservers)
+	if err != nil {
+		return err
+	}
+	p.egressDNS, p.nameservers = egressDNS, m
+	return nil
+}
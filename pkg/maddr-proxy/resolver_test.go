@@ -0,0 +1,140 @@
+package maddrproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hrntknr/maddr-proxy/pkg/utils"
+)
+
+func TestEgressResolver(t *testing.T) {
+	server, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	p := NewTestProxy(nil)
+	if err := p.SetEgressDNS(false, []string{"invalid"}); err == nil {
+		t.Fatal("expected error for invalid nameserver")
+	}
+	if _, dial := p.dnsDialer(newSource(net.ParseIP("127.0.0.2"), "tcp4")); dial != nil {
+		t.Fatal("expected the system resolver without egress dns")
+	}
+
+	if err := p.SetEgressDNS(false, []string{"*=" + server.LocalAddr().String()}); err != nil {
+		t.Fatal(err)
+	}
+	src := newSource(net.ParseIP("127.0.0.2"), "tcp4")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go p.lookupHost(ctx, src, "example.test")
+
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 512)
+	_, addr, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := addr.(*net.UDPAddr).IP; !ip.Equal(net.ParseIP("127.0.0.2")) {
+		t.Fatalf("expected query from 127.0.0.2, got %s", ip)
+	}
+}
+
+// TestSelectorResolution checks that selectors resolve the target through
+// the nameservers of the picked interface, and that dialing reuses that
+// answer instead of resolving again, even without a cache.
+func TestSelectorResolution(t *testing.T) {
+	iface := ""
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range ifaces {
+		addrs, _ := i.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && utils.IsValidIPv4(ipnet.IP) && iface == "" {
+				iface = i.Name
+			}
+		}
+	}
+	if iface == "" {
+		t.Skip("no interface with a usable IPv4 address")
+	}
+
+	for _, user := range []string{"tcp4:" + iface, "tcp4:pool:" + iface} {
+		t.Run(user, func(t *testing.T) {
+			server, queries := serveDNS(t, 60)
+			p := NewTestProxy(nil)
+			p.SetDNSCache(0)
+			if err := p.SetEgressDNS(false, []string{iface + "=" + server}); err != nil {
+				t.Fatal(err)
+			}
+			// found.test is only known to the nameserver of the interface.
+			src, err := p.resolve("found.test:80", &principal{user: user})
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := queries.Load()
+			ips, _, err := p.lookupTarget(context.Background(), src, "found.test:80")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+				t.Fatalf("unexpected addresses %v", ips)
+			}
+			if n := queries.Load(); n != before {
+				t.Fatalf("expected no further queries, got %d", n-before)
+			}
+		})
+	}
+}
+
+func TestPoolResolutionBeforePick(t *testing.T) {
+	iface := ""
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range ifaces {
+		addrs, _ := i.Addrs()
+		hasIPv4, hasIPv6 := false, false
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				hasIPv4 = hasIPv4 || utils.IsValidIPv4(ipnet.IP)
+				hasIPv6 = hasIPv6 || utils.IsValidIPv6(ipnet.IP)
+			}
+		}
+		if hasIPv4 && hasIPv6 && iface == "" {
+			iface = i.Name
+		}
+	}
+	if iface == "" {
+		t.Skip("no interface with usable IPv4 and IPv6 addresses")
+	}
+
+	// found.test only has an IPv4 address, so the IPv6 addresses of the
+	// pool must be passed over without being picked.
+	server, _ := serveDNS(t, 60)
+	p := NewTestProxy(nil)
+	if err := p.SetEgressDNS(false, []string{iface + "=" + server}); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"pool:" + iface + ";strategy=round-robin", "pool:" + iface + ";session=abc123"} {
+		src, err := p.resolve("found.test:80", &principal{user: user})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if src.network != "tcp4" {
+			t.Fatalf("%s: expected an IPv4 source, got %s", user, src)
+		}
+	}
+	if _, ok := p.sources.next["tcp6/"+iface]; ok {
+		t.Fatal("expected the IPv6 round-robin to stay untouched")
+	}
+	if leases := p.leases.list(); len(leases) != 1 || net.ParseIP(leases[0].Address).To4() == nil {
+		t.Fatalf("expected a single IPv4 lease, got %+v", leases)
+	}
+}
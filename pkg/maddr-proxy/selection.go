@@ -0,0 +1,190 @@
+package maddrproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// selection is a parsed source selector. At most one of the address,
+// interface, pool, prefix, mark, netns and vrf is set; with none of them
+// the kernel picks the source.
+type selection struct {
+	hint   string
+	addr   net.IP
+	iface  string
+	pool   *poolSpec
+	prefix string
+	mark   string
+	netns  string
+	vrf    string
+}
+
+// isKeyValueSelector tells the key=value grammar from the legacy forms,
+// whose only "=" comes after a "prefix:" as in pool:all;session=x.
+func isKeyValueSelector(s string) bool {
+	key, _, found := strings.Cut(s, "=")
+	return found && !strings.ContainsAny(key, ":;")
+}
+
+// parseSelection parses either the key=value grammar, e.g.
+// iface=eth1,family=6 or pool=eth1%2Ceth2,session=x with URL escaped
+// values, or the legacy [hint:]selector forms.
+func parseSelection(s string) (*selection, error) {
+	if s == "" {
+		return &selection{hint: "tcp"}, nil
+	}
+	if isKeyValueSelector(s) {
+		return parseKeyValueSelection(s)
+	}
+	return parseLegacySelection(s)
+}
+
+func parseKeyValueSelection(s string) (*selection, error) {
+	sel := &selection{hint: "tcp"}
+	seen := map[string]bool{}
+	var pool []string
+	var strategy, session string
+	for _, field := range strings.Split(s, ",") {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid selector field: %s", field)
+		}
+		value, err := url.PathUnescape(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector value for %s: %w", key, err)
+		}
+		if value == "" {
+			return nil, fmt.Errorf("empty selector value for %s", key)
+		}
+		// Pools may be given as a list or as repeated keys.
+		if seen[key] && key != poolPrefix {
+			return nil, fmt.Errorf("duplicate selector key: %s", key)
+		}
+		seen[key] = true
+		switch key {
+		case "family":
+			switch value {
+			case "4":
+				sel.hint = "tcp4"
+			case "6":
+				sel.hint = "tcp6"
+			default:
+				return nil, fmt.Errorf("invalid family: %s", value)
+			}
+		case "addr":
+			if sel.addr = net.ParseIP(value); sel.addr == nil {
+				return nil, fmt.Errorf("invalid address: %s", value)
+			}
+		case "iface":
+			sel.iface = value
+		case poolPrefix:
+			pool = append(pool, value)
+		case "strategy":
+			strategy = value
+		case "session":
+			session = value
+		case prefixPrefix:
+			sel.prefix = value
+		case markPrefix:
+			sel.mark = value
+		case netnsPrefix:
+			sel.netns = value
+		case vrfPrefix:
+			sel.vrf = value
+		default:
+			return nil, fmt.Errorf("unknown selector key: %s", key)
+		}
+	}
+
+	if len(pool) > 0 {
+		ps := &poolSpec{strategy: strategy, session: session}
+		for _, m := range strings.Split(strings.Join(pool, ","), ",") {
+			if m = strings.TrimSpace(m); m != "" {
+				ps.match = append(ps.match, m)
+			}
+		}
+		if len(ps.match) == 0 {
+			return nil, errors.New("empty pool selector")
+		}
+		if strategy != "" {
+			if err := validateStrategy(strategy); err != nil {
+				return nil, err
+			}
+		}
+		sel.pool = ps
+	} else if strategy != "" || session != "" {
+		return nil, errors.New("strategy and session require a pool")
+	}
+	selectors := 0
+	for _, key := range []string{"addr", "iface", poolPrefix, prefixPrefix, markPrefix, netnsPrefix, vrfPrefix} {
+		if seen[key] {
+			selectors++
+		}
+	}
+	if selectors > 1 {
+		return nil, errors.New("only one of addr, iface, pool, prefix, mark, netns and vrf may be selected")
+	}
+	if sel.addr != nil && sel.hint != "tcp" && sel.hint != addrNetwork(sel.addr) {
+		return nil, fmt.Errorf("address %s does not match family", sel.addr)
+	}
+	return sel, nil
+}
+
+// parseLegacySelection parses an address, or [tcp|tcp4|tcp6:]selector where
+// selector is an interface name or one of pool:, prefix:, mark:, netns:
+// and vrf:, which may also stand in place of the hint.
+func parseLegacySelection(s string) (*selection, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return &selection{hint: addrNetwork(ip), addr: ip}, nil
+	}
+	sel := &selection{hint: "tcp"}
+	rest := s
+	if hint, r, found := strings.Cut(s, ":"); found {
+		switch hint {
+		case poolPrefix, prefixPrefix, markPrefix, netnsPrefix, vrfPrefix:
+		case "tcp", "tcp4", "tcp6":
+			sel.hint, rest = hint, r
+		default:
+			return nil, fmt.Errorf("invalid hint: %s", hint)
+		}
+	}
+	if spec, ok := strings.CutPrefix(rest, poolPrefix+":"); ok {
+		ps, err := parsePoolSpec(spec, "")
+		if err != nil {
+			return nil, err
+		}
+		sel.pool = ps
+		return sel, nil
+	}
+	value := rest
+	field := &sel.iface
+	for _, f := range []struct {
+		prefix string
+		field  *string
+	}{
+		{prefix: prefixPrefix, field: &sel.prefix},
+		{prefix: markPrefix, field: &sel.mark},
+		{prefix: netnsPrefix, field: &sel.netns},
+		{prefix: vrfPrefix, field: &sel.vrf},
+	} {
+		if v, ok := strings.CutPrefix(rest, f.prefix+":"); ok {
+			value, field = v, f.field
+			break
+		}
+	}
+	if value == "" {
+		return nil, fmt.Errorf("empty selector: %s", s)
+	}
+	*field = value
+	return sel, nil
+}
+
+func addrNetwork(ip net.IP) string {
+	if ip.To4() == nil {
+		return "tcp6"
+	}
+	return "tcp4"
+}
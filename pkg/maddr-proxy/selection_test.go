@@ -0,0 +1,91 @@
+package maddrproxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseSelection(t *testing.T) {
+	tt := []struct {
+		user   string
+		hint   string
+		addr   string
+		iface  string
+		pool   string
+		prefix string
+		mark   string
+		netns  string
+		vrf    string
+		err    bool
+	}{
+		{user: "", hint: "tcp"},
+		{user: "10.0.0.2", hint: "tcp4", addr: "10.0.0.2"},
+		{user: "2001:db8::1", hint: "tcp6", addr: "2001:db8::1"},
+		{user: "eth0", hint: "tcp", iface: "eth0"},
+		{user: "tcp6:eth0", hint: "tcp6", iface: "eth0"},
+		{user: "pool:eth*;session=a", hint: "tcp", pool: "eth*"},
+		{user: "tcp4:pool:all;strategy=round-robin", hint: "tcp4", pool: "all"},
+		{user: "prefix:2001:db8::/64", hint: "tcp", prefix: "2001:db8::/64"},
+		{user: "tcp4:mark:isp1", hint: "tcp4", mark: "isp1"},
+		{user: "netns:isp1", hint: "tcp", netns: "isp1"},
+		{user: "vrf:vrf-blue", hint: "tcp", vrf: "vrf-blue"},
+		{user: "udp:eth0", err: true},
+		{user: "tcp4:", err: true},
+		{user: "mark:", err: true},
+
+		{user: "iface=eth1,family=6", hint: "tcp6", iface: "eth1"},
+		{user: "addr=2001%3Adb8%3A%3A1", hint: "tcp", addr: "2001:db8::1"},
+		{user: "addr=10.0.0.2,family=4", hint: "tcp4", addr: "10.0.0.2"},
+		{user: "pool=eth1%2Ceth2,session=x,strategy=least-conn", hint: "tcp", pool: "eth1,eth2"},
+		{user: "pool=eth1,pool=203.0.113.0%2F28,family=4", hint: "tcp4", pool: "eth1,203.0.113.0/28"},
+		{user: "prefix=2001%3Adb8%3A%3A%2F64", hint: "tcp", prefix: "2001:db8::/64"},
+		{user: "mark=0x10", hint: "tcp", mark: "0x10"},
+		{user: "netns=isp1,family=4", hint: "tcp4", netns: "isp1"},
+		{user: "vrf=vrf-blue", hint: "tcp", vrf: "vrf-blue"},
+		{user: "family=6", hint: "tcp6"},
+		{user: "addr=10.0.0.2,family=6", err: true},
+		{user: "iface=eth1,iface=eth2", err: true},
+		{user: "iface=eth1,pool=all", err: true},
+		{user: "iface=eth1,session=x", err: true},
+		{user: "pool=all,strategy=unknown", err: true},
+		{user: "family=5", err: true},
+		{user: "iface=", err: true},
+		{user: "iface=eth1,eth2", err: true},
+		{user: "unknown=1", err: true},
+		{user: "iface=%zz", err: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.user, func(t *testing.T) {
+			sel, err := parseSelection(tc.user)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", sel)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			pool := ""
+			if sel.pool != nil {
+				pool = strings.Join(sel.pool.match, ",")
+			}
+			if sel.hint != tc.hint || sel.iface != tc.iface || pool != tc.pool || sel.prefix != tc.prefix ||
+				sel.mark != tc.mark || sel.netns != tc.netns || sel.vrf != tc.vrf {
+				t.Fatalf("unexpected selection %+v", sel)
+			}
+			if tc.addr == "" && sel.addr != nil || tc.addr != "" && !sel.addr.Equal(net.ParseIP(tc.addr)) {
+				t.Fatalf("unexpected address %s", sel.addr)
+			}
+		})
+	}
+
+	sel, err := parseSelection("pool=all,session=x,strategy=round-robin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sel.pool.session != "x" || sel.pool.strategy != strategyRoundRobin {
+		t.Fatalf("unexpected pool %+v", sel.pool)
+	}
+}
@@ -0,0 +1,119 @@
+package maddrproxy
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const sessionTTL = 10 * time.Minute
+
+type leaseKey struct {
+	user    string
+	network string
+	pool    string
+	session string
+}
+
+type lease struct {
+	candidate sourceCandidate
+	expires   time.Time
+}
+
+type leaseInfo struct {
+	User      string    `json:"user"`
+	Network   string    `json:"network"`
+	Pool      string    `json:"pool"`
+	Session   string    `json:"session"`
+	Address   string    `json:"address"`
+	Interface string    `json:"interface"`
+	Expires   time.Time `json:"expires"`
+}
+
+type leaseTable struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	leases    map[leaseKey]*lease
+	lastSweep time.Time
+}
+
+func newLeaseTable(ttl time.Duration) *leaseTable {
+	return &leaseTable{
+		ttl:       ttl,
+		leases:    map[leaseKey]*lease{},
+		lastSweep: time.Now(),
+	}
+}
+
+// get returns the leased address for key and extends the lease, as long as
+// the address is still one of the candidates present on the host.
+func (t *leaseTable) get(key leaseKey, candidates []sourceCandidate) (sourceCandidate, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	l, ok := t.leases[key]
+	if !ok || now.After(l.expires) {
+		return sourceCandidate{}, false
+	}
+	for _, c := range candidates {
+		if c.ip.Equal(l.candidate.ip) {
+			l.expires = now.Add(t.ttl)
+			return l.candidate, true
+		}
+	}
+	return sourceCandidate{}, false
+}
+
+func (t *leaseTable) set(key leaseKey, c sourceCandidate) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if now.Sub(t.lastSweep) > t.ttl {
+		for k, l := range t.leases {
+			if now.After(l.expires) {
+				delete(t.leases, k)
+			}
+		}
+		t.lastSweep = now
+	}
+	t.leases[key] = &lease{candidate: c, expires: now.Add(t.ttl)}
+}
+
+func (t *leaseTable) list() []leaseInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	ret := []leaseInfo{}
+	for k, l := range t.leases {
+		if now.After(l.expires) {
+			continue
+		}
+		ret = append(ret, leaseInfo{
+			User:      k.user,
+			Network:   k.network,
+			Pool:      k.pool,
+			Session:   k.session,
+			Address:   l.candidate.ip.String(),
+			Interface: l.candidate.iface,
+			Expires:   l.expires,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Session != ret[j].Session {
+			return ret[i].Session < ret[j].Session
+		}
+		return ret[i].Network < ret[j].Network
+	})
+	return ret
+}
+
+func (p *proxy) pickSession(key leaseKey, strategy string, candidates []sourceCandidate) net.IP {
+	if c, ok := p.leases.get(key, candidates); ok {
+		return c.ip
+	}
+	c := p.sources.pick(key.network+"/"+key.pool, strategy, candidates)
+	p.leases.set(key, c)
+	return c.ip
+}
@@ -0,0 +1,47 @@
+package maddrproxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSessionLease(t *testing.T) {
+	candidates := []sourceCandidate{
+		{iface: "eth1", ip: net.ParseIP("192.0.2.1")},
+		{iface: "eth1", ip: net.ParseIP("192.0.2.2")},
+		{iface: "eth2", ip: net.ParseIP("192.0.2.3")},
+	}
+	p := NewProxy([]string{})
+	p.SetSessionTTL(50 * time.Millisecond)
+	key := leaseKey{user: "alice", network: "tcp4", pool: "eth*", session: "abc123"}
+
+	leased := p.pickSession(key, strategyRoundRobin, candidates)
+	for i := 0; i < 5; i++ {
+		if ip := p.pickSession(key, strategyRoundRobin, candidates); !ip.Equal(leased) {
+			t.Fatalf("expected sticky address %s, got %s", leased, ip)
+		}
+	}
+	if leases := p.leases.list(); len(leases) != 1 || leases[0].Address != leased.String() {
+		t.Fatalf("unexpected leases %+v", leases)
+	}
+
+	remaining := []sourceCandidate{}
+	for _, c := range candidates {
+		if !c.ip.Equal(leased) {
+			remaining = append(remaining, c)
+		}
+	}
+	rebalanced := p.pickSession(key, strategyRoundRobin, remaining)
+	if rebalanced.Equal(leased) {
+		t.Fatal("expected lease to move off the removed address")
+	}
+	if ip := p.pickSession(key, strategyRoundRobin, candidates); !ip.Equal(rebalanced) {
+		t.Fatalf("expected sticky address %s after rebalance, got %s", rebalanced, ip)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if leases := p.leases.list(); len(leases) != 0 {
+		t.Fatalf("expected lease to expire, got %+v", leases)
+	}
+}
@@ -9,16 +9,61 @@ import (
 
 	"github.com/hrntknr/maddr-proxy/pkg/utils"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 const iprouteProtocol = 151
 const priority = 15100
 
 const tableMain = 254
+const tableLocal = 255
 const tableRangeStart = 15100
 const tableRangeEnd = 15199
 
-func SetupRoute(watch bool, iface []string, gw []string, useHostMinAsGw bool) error {
+type RouteConfig struct {
+	Iface          []string
+	Gw             []string
+	UseHostMinAsGw bool
+	LocalPrefix    []string
+	// Fwmark maps marks to interfaces as mark=iface. Each gets a rule
+	// pointing at a table routed through the interface.
+	Fwmark []string
+	// NoSourceRules skips the per-address "from <addr>" rules, leaving
+	// only the fwmark rules.
+	NoSourceRules bool
+}
+
+type routeMark struct {
+	mark  uint32
+	iface string
+}
+
+func parseRouteMarks(fwmark []string) ([]routeMark, error) {
+	marks := []routeMark{}
+	for _, f := range fwmark {
+		value, iface, found := strings.Cut(f, "=")
+		if !found || iface == "" {
+			return nil, fmt.Errorf("invalid fwmark: %s", f)
+		}
+		mark, err := parseMark(value)
+		if err != nil {
+			return nil, err
+		}
+		marks = append(marks, routeMark{mark: mark, iface: iface})
+	}
+	return marks, nil
+}
+
+func SetupRoute(watch bool, config RouteConfig) error {
+	prefixes, err := parseLocalPrefixes(config.LocalPrefix)
+	if err != nil {
+		return err
+	}
+	marks, err := parseRouteMarks(config.Fwmark)
+	if err != nil {
+		return err
+	}
+
 	if watch {
 		route := make(chan netlink.RouteUpdate)
 		addr := make(chan netlink.AddrUpdate)
@@ -33,7 +78,7 @@ func SetupRoute(watch bool, iface []string, gw []string, useHostMinAsGw bool) er
 			return err
 		}
 		for {
-			if err := ensureSetupRoute(iface, gw, useHostMinAsGw); err != nil {
+			if err := ensureSetupRoute(config, prefixes, marks); err != nil {
 				return err
 			}
 			select {
@@ -43,29 +88,113 @@ func SetupRoute(watch bool, iface []string, gw []string, useHostMinAsGw bool) er
 			}
 		}
 	} else {
-		return ensureSetupRoute(iface, gw, useHostMinAsGw)
+		return ensureSetupRoute(config, prefixes, marks)
 	}
 }
 
-func ensureSetupRoute(iface []string, gw []string, useHostMinAsGw bool) error {
-	mapping, err := ensureRules(iface)
+func ensureSetupRoute(config RouteConfig, prefixes []*net.IPNet, marks []routeMark) error {
+	mapping, err := ensureRules(config.Iface, marks, !config.NoSourceRules)
 	if err != nil {
 		return err
 	}
-	if err := ensureRoutes(mapping, gw, useHostMinAsGw); err != nil {
+	if err := ensureRoutes(mapping, config.Gw, config.UseHostMinAsGw, true); err != nil {
 		return err
 	}
+	vrfMapping, err := getVrfTables(config.Iface)
+	if err != nil {
+		return err
+	}
+	if err := ensureRoutes(vrfMapping, config.Gw, config.UseHostMinAsGw, false); err != nil {
+		return err
+	}
+	if err := ensureLocalRoutes(prefixes); err != nil {
+		return err
+	}
+	return nil
+}
+
+func parseLocalPrefixes(localPrefix []string) ([]*net.IPNet, error) {
+	prefixes := []*net.IPNet{}
+	for _, p := range localPrefix {
+		_, ipnet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid local prefix: %w", err)
+		}
+		prefixes = append(prefixes, ipnet)
+	}
+	return prefixes, nil
+}
+
+// ensureLocalRoutes installs "local <prefix> dev lo" routes so that the
+// host accepts traffic for every address in prefixes routed to it, which
+// is what lets the prefix: selector bind to unassigned addresses.
+func ensureLocalRoutes(prefixes []*net.IPNet) error {
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		return err
+	}
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		wanted := []*net.IPNet{}
+		for _, prefix := range prefixes {
+			if getFamily(prefix.IP) == family {
+				wanted = append(wanted, prefix)
+			}
+		}
+		routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: tableLocal, Protocol: iprouteProtocol}, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_PROTOCOL)
+		if err != nil {
+			return err
+		}
+		found := map[string]struct{}{}
+		for _, route := range routes {
+			keep := false
+			for _, prefix := range wanted {
+				if route.Dst != nil && route.Dst.String() == prefix.String() && route.LinkIndex == lo.Attrs().Index {
+					keep = true
+					break
+				}
+			}
+			if keep {
+				found[route.Dst.String()] = struct{}{}
+				continue
+			}
+			if err := netlink.RouteDel(&route); err != nil {
+				return fmt.Errorf("failed to delete route: %w", err)
+			}
+		}
+		for _, prefix := range wanted {
+			if _, ok := found[prefix.String()]; ok {
+				continue
+			}
+			if err := netlink.RouteAdd(&netlink.Route{
+				Dst:       prefix,
+				LinkIndex: lo.Attrs().Index,
+				Scope:     netlink.SCOPE_HOST,
+				Protocol:  iprouteProtocol,
+				Table:     tableLocal,
+				Type:      unix.RTN_LOCAL,
+			}); err != nil {
+				return fmt.Errorf("failed to add route: %w", err)
+			}
+		}
+	}
 	return nil
 }
 
-func ensureRoutes(mapping map[int]map[int]int, gw []string, useHostMinAsGw bool) error {
+func getFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+func ensureRoutes(mapping map[int]map[int]int, gw []string, useHostMinAsGw bool, exclusive bool) error {
 	for family, m := range mapping {
 		for table, device := range m {
 			gw, err := resolveGw(family, device, gw, useHostMinAsGw)
 			if err != nil {
 				return err
 			}
-			if err := ensureRoute(family, table, device, gw); err != nil {
+			if err := ensureRoute(family, table, device, gw, exclusive); err != nil {
 				return err
 			}
 		}
@@ -73,7 +202,11 @@ func ensureRoutes(mapping map[int]map[int]int, gw []string, useHostMinAsGw bool)
 	return nil
 }
 
-func ensureRoute(family int, table int, device int, gw net.IP) error {
+// ensureRoute installs the default route of table. An exclusive table is
+// owned by setup-route and anything else in it is removed, otherwise only
+// routes installed by setup-route are touched, and a default route that
+// someone else installed is left in place of ours.
+func ensureRoute(family int, table int, device int, gw net.IP, exclusive bool) error {
 	routes, err := getRoutes(family, table)
 	if err != nil {
 		return err
@@ -81,6 +214,12 @@ func ensureRoute(family int, table int, device int, gw net.IP) error {
 
 	find := false
 	for _, route := range routes {
+		if !exclusive && route.Protocol != iprouteProtocol {
+			if isDefaultRoute(route.Dst) {
+				find = true
+			}
+			continue
+		}
 		if isDefaultRoute(route.Dst) &&
 			route.LinkIndex == device &&
 			route.Scope == netlink.SCOPE_UNIVERSE &&
@@ -103,6 +242,9 @@ func ensureRoute(family int, table int, device int, gw net.IP) error {
 			Table:     table,
 			Gw:        gw,
 		}); err != nil {
+			if !exclusive && errors.Is(err, unix.EEXIST) {
+				return nil
+			}
 			return fmt.Errorf("failed to add route: %w", err)
 		}
 	}
@@ -119,7 +261,7 @@ func getDefaultRoute(family int) *net.IPNet {
 	return nil
 }
 
-func ensureRules(iface []string) (map[int]map[int]int, error) {
+func ensureRules(iface []string, marks []routeMark, sourceRules bool) (map[int]map[int]int, error) {
 	links, err := getLinks(iface)
 	if err != nil {
 		return nil, err
@@ -131,16 +273,39 @@ func ensureRules(iface []string) (map[int]map[int]int, error) {
 			return nil, err
 		}
 		newLinks := []netlink.Link{}
+		names := map[int]string{}
 		for _, link := range links {
+			vrf, err := getVrf(link)
+			if err != nil {
+				return nil, err
+			}
+			if vrf != nil {
+				continue
+			}
 			if link.Attrs().Index != defaultRouteIface {
 				newLinks = append(newLinks, link)
+				names[link.Attrs().Index] = link.Attrs().Name
 			}
 		}
 		addrs, err := getAddrList(newLinks, family)
 		if err != nil {
 			return nil, err
 		}
-		mapping, err := ensureRule(addrs, family)
+		targets := []ruleTarget{}
+		if sourceRules {
+			for _, addr := range addrs {
+				targets = append(targets, ruleTarget{src: addr.IP, link: addr.LinkIndex})
+			}
+		}
+		for _, m := range marks {
+			for _, addr := range addrs {
+				if names[addr.LinkIndex] == m.iface {
+					targets = append(targets, ruleTarget{mark: m.mark, link: addr.LinkIndex})
+					break
+				}
+			}
+		}
+		mapping, err := ensureRule(targets, family)
 		if err != nil {
 			return nil, err
 		}
@@ -149,6 +314,54 @@ func ensureRules(iface []string) (map[int]map[int]int, error) {
 	return ret, nil
 }
 
+// getVrf returns the VRF link is enslaved to, if any.
+func getVrf(link netlink.Link) (*netlink.Vrf, error) {
+	if link.Attrs().MasterIndex == 0 {
+		return nil, nil
+	}
+	master, err := netlink.LinkByIndex(link.Attrs().MasterIndex)
+	if err != nil {
+		return nil, err
+	}
+	vrf, _ := master.(*netlink.Vrf)
+	return vrf, nil
+}
+
+// getVrfTables maps the tables of the VRFs that matching interfaces are
+// enslaved to onto those interfaces. The VRF already steers its traffic
+// into its table, so no rules are needed and the default route goes
+// there rather than into a table of our own.
+func getVrfTables(iface []string) (map[int]map[int]int, error) {
+	links, err := getLinks(iface)
+	if err != nil {
+		return nil, err
+	}
+	ret := map[int]map[int]int{}
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		ret[family] = map[int]int{}
+		for _, link := range links {
+			vrf, err := getVrf(link)
+			if err != nil {
+				return nil, err
+			}
+			if vrf == nil {
+				continue
+			}
+			if _, ok := ret[family][int(vrf.Table)]; ok {
+				continue
+			}
+			addrs, err := getAddrList([]netlink.Link{link}, family)
+			if err != nil {
+				return nil, err
+			}
+			if len(addrs) > 0 {
+				ret[family][int(vrf.Table)] = link.Attrs().Index
+			}
+		}
+	}
+	return ret, nil
+}
+
 func getRoutes(family int, table int) ([]netlink.Route, error) {
 	routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
 	if err != nil {
@@ -212,7 +425,25 @@ func getAddrList(links []netlink.Link, family int) ([]netlink.Addr, error) {
 	return filtered, nil
 }
 
-func ensureRule(addrs []netlink.Addr, family int) (map[int]int, error) {
+// ruleTarget is a rule managed by setup-route: either "from <src>" or
+// "fwmark <mark>", looking up a table routed through link.
+type ruleTarget struct {
+	src  net.IP
+	mark uint32
+	link int
+}
+
+func (t ruleTarget) match(family int, rule netlink.Rule) bool {
+	if !isDefaultRoute(rule.Dst) {
+		return false
+	}
+	if t.mark != 0 {
+		return rule.Mark == t.mark && rule.Src == nil
+	}
+	return rule.Mark == 0 && matchIP(family, rule.Src, t.src)
+}
+
+func ensureRule(targets []ruleTarget, family int) (map[int]int, error) {
 	rules, err := netlink.RuleList(family)
 	if err != nil {
 		return nil, err
@@ -228,8 +459,8 @@ func ensureRule(addrs []netlink.Addr, family int) (map[int]int, error) {
 
 	for _, rule := range filtered {
 		found := false
-		for _, addr := range addrs {
-			if isDefaultRoute(rule.Dst) && matchIP(family, rule.Src, addr.IP) {
+		for _, target := range targets {
+			if target.match(family, rule) {
 				found = true
 				break
 			}
@@ -240,11 +471,11 @@ func ensureRule(addrs []netlink.Addr, family int) (map[int]int, error) {
 			}
 		}
 	}
-	for _, addr := range addrs {
+	for _, target := range targets {
 		found := false
 		for _, rule := range filtered {
-			if isDefaultRoute(rule.Dst) && matchIP(family, rule.Src, addr.IP) {
-				mapping[rule.Table] = addr.LinkIndex
+			if target.match(family, rule) {
+				mapping[rule.Table] = target.link
 				found = true
 				break
 			}
@@ -254,16 +485,20 @@ func ensureRule(addrs []netlink.Addr, family int) (map[int]int, error) {
 			if err != nil {
 				return nil, err
 			}
-			mask := getMaskSize(family)
 			rule := netlink.NewRule()
 			rule.Family = family
 			rule.Priority = priority
 			rule.Table = table
-			rule.Src = &net.IPNet{IP: addr.IP, Mask: net.CIDRMask(mask, mask)}
+			if target.mark != 0 {
+				rule.Mark = target.mark
+			} else {
+				mask := getMaskSize(family)
+				rule.Src = &net.IPNet{IP: target.src, Mask: net.CIDRMask(mask, mask)}
+			}
 			if err := netlink.RuleAdd(rule); err != nil {
 				return nil, fmt.Errorf("failed to add rule: %w", err)
 			}
-			mapping[table] = addr.LinkIndex
+			mapping[table] = target.link
 		}
 	}
 
@@ -0,0 +1,286 @@
+package maddrproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/hrntknr/maddr-proxy/pkg/utils"
+)
+
+const socksVersion = 0x05
+
+const (
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xff
+)
+
+const socksAuthPasswordVersion = 0x01
+
+const (
+	socksCmdConnect      = 0x01
+	socksCmdBind         = 0x02
+	socksCmdUDPAssociate = 0x03
+)
+
+const (
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+)
+
+const (
+	socksRepSucceeded               = 0x00
+	socksRepGeneralFailure          = 0x01
+	socksRepNotAllowed              = 0x02
+	socksRepNetworkUnreachable      = 0x03
+	socksRepHostUnreachable         = 0x04
+	socksRepConnectionRefused       = 0x05
+	socksRepTTLExpired              = 0x06
+	socksRepCommandNotSupported     = 0x07
+	socksRepAddressTypeNotSupported = 0x08
+)
+
+type socksError struct {
+	rep byte
+	err error
+}
+
+func (e *socksError) Error() string {
+	return e.err.Error()
+}
+
+func (e *socksError) Unwrap() error {
+	return e.err
+}
+
+func (p *proxy) socksHandshake(conn net.Conn) (*principal, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported socks version: %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+
+	offerNone, offerPassword := false, false
+	for _, m := range methods {
+		switch m {
+		case socksAuthNone:
+			offerNone = true
+		case socksAuthPassword:
+			offerPassword = true
+		}
+	}
+
+	// The username carries the source address selector, so prefer
+	// username/password authentication whenever the client offers it.
+	switch {
+	case offerPassword:
+		if _, err := conn.Write([]byte{socksVersion, socksAuthPassword}); err != nil {
+			return nil, err
+		}
+		return p.socksPasswordAuth(conn)
+	case offerNone && p.verifier == nil:
+		if _, err := conn.Write([]byte{socksVersion, socksAuthNone}); err != nil {
+			return nil, err
+		}
+		return p.newPrincipal(""), nil
+	default:
+		conn.Write([]byte{socksVersion, socksAuthNoAcceptable})
+		return nil, errors.New("no acceptable authentication method")
+	}
+}
+
+func (p *proxy) socksPasswordAuth(conn net.Conn) (*principal, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socksAuthPasswordVersion {
+		return nil, fmt.Errorf("unsupported auth version: %d", header[0])
+	}
+	user := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return nil, err
+	}
+	password := make([]byte, header[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return nil, err
+	}
+
+	if _, err := utils.Authenticate(p.verifier, string(user), string(password)); err != nil {
+		conn.Write([]byte{socksAuthPasswordVersion, 0x01})
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{socksAuthPasswordVersion, 0x00}); err != nil {
+		return nil, err
+	}
+	return p.newPrincipal(string(user)), nil
+}
+
+func readSocksAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case socksAtypIPv4:
+		ip := make(net.IP, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAtypIPv6:
+		ip := make(net.IP, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		if _, err := io.ReadFull(r, atyp); err != nil {
+			return "", err
+		}
+		domain := make([]byte, atyp[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", &socksError{rep: socksRepAddressTypeNotSupported, err: fmt.Errorf("unsupported address type: %d", atyp[0])}
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func appendSocksAddr(b []byte, addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socksAtypIPv4)
+		b = append(b, ip4...)
+	} else if ip != nil {
+		b = append(b, socksAtypIPv6)
+		b = append(b, ip.To16()...)
+	} else {
+		b = append(b, socksAtypIPv4)
+		b = append(b, net.IPv4zero.To4()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+func writeSocksReply(conn net.Conn, rep byte, addr net.Addr) error {
+	_, err := conn.Write(appendSocksAddr([]byte{socksVersion, rep, 0x00}, addr))
+	return err
+}
+
+func socksReplyCode(err error) byte {
+	var serr *socksError
+	var perr *policyError
+	var nerr net.Error
+	switch {
+	case errors.As(err, &serr):
+		return serr.rep
+	case errors.As(err, &perr):
+		return socksRepNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksRepConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksRepNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return socksRepHostUnreachable
+	case errors.As(err, &nerr) && nerr.Timeout():
+		return socksRepTTLExpired
+	default:
+		return socksRepGeneralFailure
+	}
+}
+
+func (p *proxy) socksConnect(conn net.Conn, target string, pr *principal) {
+	peer, _, err := p.dial(target, pr)
+	if err != nil {
+		writeSocksReply(conn, socksReplyCode(err), nil)
+		return
+	}
+	defer peer.Close()
+
+	if err := writeSocksReply(conn, socksRepSucceeded, peer.LocalAddr()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	relay(conn, peer)
+}
+
+func (p *proxy) serveSocks(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	pr, err := p.socksHandshake(conn)
+	if err != nil {
+		return
+	}
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if header[0] != socksVersion {
+		return
+	}
+	target, err := readSocksAddr(conn)
+	if err != nil {
+		writeSocksReply(conn, socksReplyCode(err), nil)
+		return
+	}
+
+	switch header[1] {
+	case socksCmdConnect:
+		p.socksConnect(conn, target, pr)
+	case socksCmdUDPAssociate:
+		p.socksUDPAssociate(conn, target, pr)
+	default:
+		writeSocksReply(conn, socksRepCommandNotSupported, nil)
+	}
+}
+
+func (p *proxy) ListenAndServeSocks(addr string) error {
+	if p.clientCAs != nil {
+		return errClientCANeedsTLS
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go p.serveSocks(conn)
+	}
+}
@@ -0,0 +1,283 @@
+package maddrproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hrntknr/maddr-proxy/pkg/utils"
+)
+
+const socksUDPReassemblyTimeout = 5 * time.Second
+const socksUDPBufferSize = 65535
+
+const socksFragEnd = 0x80
+
+type udpAssociation struct {
+	p        *proxy
+	pr       *principal
+	conn     net.Conn
+	relay    *net.UDPConn
+	clientIP net.IP
+	expect   *net.UDPAddr
+
+	mu         sync.Mutex
+	clientAddr *net.UDPAddr
+	peers      map[string]*net.UDPConn
+	targets    map[string]*udpTarget
+	idle       *time.Timer
+	closed     bool
+
+	fragPos      byte
+	fragBuf      []byte
+	fragDeadline time.Time
+}
+
+// udpTarget is the socket and address a target is relayed through. It is
+// chosen on the first datagram to the target, so that a flow keeps one
+// source even with selectors that pick a different address on each call.
+type udpTarget struct {
+	peer  *net.UDPConn
+	raddr *net.UDPAddr
+}
+
+func udpEgress(src *source) (*net.UDPAddr, string) {
+	var laddr *net.UDPAddr
+	if a, ok := src.addr.(*net.TCPAddr); ok && a != nil {
+		laddr = &net.UDPAddr{IP: a.IP, Port: 0, Zone: a.Zone}
+	}
+	switch src.network {
+	case "tcp4":
+		return laddr, "udp4"
+	case "tcp6":
+		return laddr, "udp6"
+	default:
+		return laddr, "udp"
+	}
+}
+
+func (a *udpAssociation) touch() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.closed {
+		a.idle.Reset(a.p.udpTimeout)
+	}
+}
+
+func (a *udpAssociation) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return
+	}
+	a.closed = true
+	a.idle.Stop()
+	a.conn.Close()
+	a.relay.Close()
+	for _, peer := range a.peers {
+		peer.Close()
+	}
+}
+
+func (a *udpAssociation) acceptClient(from *net.UDPAddr) bool {
+	if !from.IP.Equal(a.clientIP) {
+		return false
+	}
+	if a.expect != nil {
+		if a.expect.Port != 0 && a.expect.Port != from.Port {
+			return false
+		}
+		if !a.expect.IP.IsUnspecified() && !a.expect.IP.Equal(from.IP) {
+			return false
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.clientAddr == nil {
+		a.clientAddr = from
+		return true
+	}
+	return a.clientAddr.Port == from.Port
+}
+
+// reassemble implements the fragmentation rules of RFC 1928 section 7:
+// fragments carry positions 1-127 with the high bit marking the last one,
+// a position lower than the current one abandons the queue, and an
+// incomplete queue is dropped after the reassembly timer expires.
+func (a *udpAssociation) reassemble(frag byte, data []byte) ([]byte, bool) {
+	if frag == 0 {
+		a.fragPos, a.fragBuf = 0, nil
+		return data, true
+	}
+	pos := frag &^ socksFragEnd
+	if a.fragPos != 0 && time.Now().After(a.fragDeadline) {
+		a.fragPos, a.fragBuf = 0, nil
+	}
+	if pos != a.fragPos+1 {
+		a.fragPos, a.fragBuf = 0, nil
+		if pos != 1 {
+			return nil, false
+		}
+	}
+	if a.fragPos == 0 {
+		a.fragDeadline = time.Now().Add(socksUDPReassemblyTimeout)
+	}
+	a.fragPos = pos
+	a.fragBuf = append(a.fragBuf, data...)
+	if frag&socksFragEnd == 0 {
+		return nil, false
+	}
+	buf := a.fragBuf
+	a.fragPos, a.fragBuf = 0, nil
+	return buf, true
+}
+
+func (a *udpAssociation) peer(target string) (*net.UDPConn, *net.UDPAddr, error) {
+	a.mu.Lock()
+	t, ok := a.targets[target]
+	a.mu.Unlock()
+	if ok {
+		return t.peer, t.raddr, nil
+	}
+
+	src, err := a.p.selectSource(target, a.pr)
+	if err != nil {
+		return nil, nil, err
+	}
+	laddr, network := udpEgress(src)
+	ips, port, err := a.p.lookupTarget(context.Background(), src, target)
+	if err != nil {
+		return nil, nil, err
+	}
+	var raddr *net.UDPAddr
+	for _, ip := range ips {
+		if matchFamily(network, ip) {
+			raddr, err = net.ResolveUDPAddr(network, net.JoinHostPort(ip.String(), port))
+			if err != nil {
+				return nil, nil, err
+			}
+			break
+		}
+	}
+	if raddr == nil {
+		return nil, nil, fmt.Errorf("no %s address found for %s", network, target)
+	}
+	key := network + "/" + laddr.String()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil, nil, net.ErrClosed
+	}
+	peer, ok := a.peers[key]
+	if !ok {
+		if err := a.p.namespaces.in(src.netns, func() error {
+			var err error
+			peer, err = utils.ListenPacket(network, laddr, src.options()...)
+			return err
+		}); err != nil {
+			return nil, nil, err
+		}
+		a.peers[key] = peer
+		go a.servePeer(peer)
+	}
+	a.targets[target] = &udpTarget{peer: peer, raddr: raddr}
+	return peer, raddr, nil
+}
+
+func (a *udpAssociation) servePeer(peer *net.UDPConn) {
+	buf := make([]byte, socksUDPBufferSize)
+	for {
+		n, from, err := peer.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		a.mu.Lock()
+		client := a.clientAddr
+		a.mu.Unlock()
+		if client == nil {
+			continue
+		}
+		a.touch()
+		b := appendSocksAddr([]byte{0x00, 0x00, 0x00}, from)
+		b = append(b, buf[:n]...)
+		a.relay.WriteToUDP(b, client)
+	}
+}
+
+func (a *udpAssociation) serveClient() {
+	buf := make([]byte, socksUDPBufferSize)
+	for {
+		n, from, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < 4 || !a.acceptClient(from) {
+			continue
+		}
+		a.touch()
+		r := bytes.NewReader(buf[3:n])
+		target, err := readSocksAddr(r)
+		if err != nil {
+			continue
+		}
+		data, ok := a.reassemble(buf[2], buf[n-r.Len():n])
+		if !ok {
+			continue
+		}
+		peer, raddr, err := a.peer(target)
+		if err != nil {
+			continue
+		}
+		peer.WriteToUDP(data, raddr)
+	}
+}
+
+func (p *proxy) socksUDPAssociate(conn net.Conn, expect string, pr *principal) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		writeSocksReply(conn, socksRepGeneralFailure, nil)
+		return
+	}
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		writeSocksReply(conn, socksRepGeneralFailure, nil)
+		return
+	}
+	expectAddr, err := net.ResolveUDPAddr("udp", expect)
+	if err != nil {
+		writeSocksReply(conn, socksRepGeneralFailure, nil)
+		return
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		writeSocksReply(conn, socksReplyCode(err), nil)
+		return
+	}
+
+	a := &udpAssociation{
+		p:        p,
+		pr:       pr,
+		conn:     conn,
+		relay:    relay,
+		clientIP: remote.IP,
+		expect:   expectAddr,
+		peers:    map[string]*net.UDPConn{},
+		targets:  map[string]*udpTarget{},
+	}
+	a.idle = time.AfterFunc(p.udpTimeout, a.close)
+	defer a.close()
+
+	if err := writeSocksReply(conn, socksRepSucceeded, relay.LocalAddr()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	go a.serveClient()
+
+	// The association lives as long as the control connection does.
+	io.Copy(io.Discard, conn)
+}
@@ -0,0 +1,229 @@
+package maddrproxy
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSocksProxy(t *testing.T) {
+	tt := []struct {
+		name    string
+		auth    []string
+		user    *url.Userinfo
+		success bool
+	}{
+		{
+			name:    "normal",
+			success: true,
+		},
+		{
+			name:    "auth required",
+			auth:    []string{"password"},
+			success: false,
+		},
+		{
+			name:    "auth forbidden",
+			auth:    []string{"password"},
+			user:    url.UserPassword("", "test"),
+			success: false,
+		},
+		{
+			name:    "auth ok",
+			auth:    []string{"password"},
+			user:    url.UserPassword("", "password"),
+			success: true,
+		},
+		{
+			name:    "address",
+			user:    url.UserPassword("127.0.0.1", ""),
+			success: true,
+		},
+		{
+			name:    "invalid hint",
+			user:    url.UserPassword("udp:lo", ""),
+			success: false,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			dummyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer dummyServer.Close()
+			ln, err := NewSocksListener(NewTestProxy(tc.auth))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			resp, err := NewSocksClient(ln.Addr().String(), tc.user).Get(dummyServer.URL)
+			if !tc.success {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestSocksUDPAssociate(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, socksUDPBufferSize)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	ln, err := NewSocksListener(NewTestProxy([]string{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := SocksHandshake(conn, url.UserPassword("127.0.0.1", "")); err != nil {
+		t.Fatal(err)
+	}
+	bound, err := SocksRequest(conn, socksCmdUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: bound.(*net.TCPAddr).IP, Port: bound.(*net.TCPAddr).Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	tt := []struct {
+		name      string
+		fragments map[byte]string
+		expected  string
+	}{
+		{
+			name:      "single",
+			fragments: map[byte]string{0x00: "hello"},
+			expected:  "hello",
+		},
+		{
+			name:      "fragmented",
+			fragments: map[byte]string{0x01: "hel", 0x02: "lo, ", 0x83: "world"},
+			expected:  "hello, world",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, frag := range []byte{0x00, 0x01, 0x02, 0x83} {
+				data, ok := tc.fragments[frag]
+				if !ok {
+					continue
+				}
+				b := appendSocksAddr([]byte{0x00, 0x00, frag}, echo.LocalAddr())
+				if _, err := client.Write(append(b, data...)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			client.SetReadDeadline(time.Now().Add(timeout))
+			buf := make([]byte, socksUDPBufferSize)
+			n, err := client.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := bytes.NewReader(buf[3:n])
+			from, err := readSocksAddr(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if from != echo.LocalAddr().String() {
+				t.Fatalf("expected from %s, got %s", echo.LocalAddr(), from)
+			}
+			if got := string(buf[n-r.Len() : n]); got != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestSocksUDPAssociatePinnedSource(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	sources := make(chan string, 20)
+	go func() {
+		buf := make([]byte, socksUDPBufferSize)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			sources <- from.String()
+			echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	ln, err := NewSocksListener(NewTestProxy([]string{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := SocksHandshake(conn, url.UserPassword("prefix:127.0.0.0/8", "")); err != nil {
+		t.Fatal(err)
+	}
+	bound, err := SocksRequest(conn, socksCmdUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: bound.(*net.TCPAddr).IP, Port: bound.(*net.TCPAddr).Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Every datagram of the flow leaves from the address picked for the
+	// first one.
+	seen := map[string]bool{}
+	buf := make([]byte, socksUDPBufferSize)
+	for i := 0; i < 20; i++ {
+		b := appendSocksAddr([]byte{0x00, 0x00, 0x00}, echo.LocalAddr())
+		if _, err := client.Write(append(b, "ping"...)); err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(timeout))
+		if _, err := client.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		seen[<-sources] = true
+	}
+	if len(seen) != 1 {
+		t.Fatalf("expected a single source, got %v", seen)
+	}
+}
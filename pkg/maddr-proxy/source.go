@@ -0,0 +1,219 @@
+package maddrproxy
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hrntknr/maddr-proxy/pkg/utils"
+	"github.com/vishvananda/netlink"
+)
+
+const prefixPrefix = "prefix"
+const markPrefix = "mark"
+const vrfPrefix = "vrf"
+
+type source struct {
+	addr     net.Addr
+	network  string
+	iface    string
+	freebind bool
+	prefix   string
+	device   string
+	mark     uint32
+	markName string
+	netns    string
+
+	// targetIPs are the addresses of the target resolved for this source
+	// while selecting it, or nil if they are still to be looked up.
+	targetIPs []net.IP
+	// fallbacks are the other addresses of the same pool or interface,
+	// tried in order on failover.
+	fallbacks []*source
+	// eyeballs is the source of the other family, raced against this one
+	// when the selector does not pin a family.
+	eyeballs *source
+}
+
+// setTargetIPs hands the addresses resolved for s on to the sources that
+// share its interface.
+func (s *source) setTargetIPs(ips []net.IP) {
+	s.targetIPs = ips
+	for _, f := range s.fallbacks {
+		f.targetIPs = ips
+	}
+	if s.eyeballs != nil {
+		s.eyeballs.targetIPs = ips
+	}
+}
+
+func newSource(ip net.IP, network string) *source {
+	return &source{addr: &net.TCPAddr{IP: ip, Port: 0}, network: network}
+}
+
+func (s *source) String() string {
+	switch {
+	case s.addr != nil:
+		return s.ip().String()
+	case s.device != "":
+		return s.device
+	case s.mark != 0:
+		return markPrefix + ":" + s.markName
+	case s.netns != "":
+		return netnsPrefix + ":" + s.netns
+	default:
+		return ""
+	}
+}
+
+// isFailoverError reports whether a dial error suggests that the source
+// cannot reach the target, as opposed to a problem with the target itself.
+func isFailoverError(err error) bool {
+	var nerr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ENETUNREACH),
+		errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.EADDRNOTAVAIL):
+		return true
+	case errors.As(err, &nerr) && nerr.Timeout():
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *source) ip() net.IP {
+	if a, ok := s.addr.(*net.TCPAddr); ok && a != nil {
+		return a.IP
+	}
+	return nil
+}
+
+func (s *source) options() []utils.SocketOption {
+	opts := []utils.SocketOption{}
+	if s.freebind {
+		opts = append(opts, utils.Freebind())
+	}
+	if s.device != "" {
+		opts = append(opts, utils.BindToDevice(s.device))
+	}
+	if s.mark != 0 {
+		opts = append(opts, utils.Mark(s.mark))
+	}
+	return opts
+}
+
+func parseMark(s string) (uint32, error) {
+	mark, err := strconv.ParseUint(s, 0, 32)
+	if err != nil || mark == 0 {
+		return 0, fmt.Errorf("invalid mark: %s", s)
+	}
+	return uint32(mark), nil
+}
+
+func parseMarks(marks []string) (map[string]uint32, error) {
+	ret := map[string]uint32{}
+	for _, m := range marks {
+		name, value, found := strings.Cut(m, "=")
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid mark: %s", m)
+		}
+		mark, err := parseMark(value)
+		if err != nil {
+			return nil, err
+		}
+		ret[name] = mark
+	}
+	return ret, nil
+}
+
+// resolveMark selects egress by firewall mark, leaving the choice of
+// route and source address to fwmark rules on the host. The mark is
+// either a configured name or a number.
+func (p *proxy) resolveMark(hint string, spec string) (*source, error) {
+	mark, ok := p.marks[spec]
+	if !ok {
+		var err error
+		if mark, err = parseMark(spec); err != nil {
+			return nil, fmt.Errorf("unknown mark: %s", spec)
+		}
+	}
+	return &source{network: hint, mark: mark, markName: spec}, nil
+}
+
+// resolveVrf binds to the VRF master device, so that routing and the
+// source address come from the VRF's table.
+func (p *proxy) resolveVrf(hint string, name string) (*source, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find vrf: %w", err)
+	}
+	if _, ok := link.(*netlink.Vrf); !ok {
+		return nil, fmt.Errorf("%s is not a vrf", name)
+	}
+	return &source{network: hint, device: name}, nil
+}
+
+func randomIP(ipnet *net.IPNet) (net.IP, error) {
+	ip := make(net.IP, len(ipnet.IP))
+	if _, err := rand.Read(ip); err != nil {
+		return nil, err
+	}
+	for i := range ip {
+		ip[i] = ipnet.IP[i]&ipnet.Mask[i] | ip[i]&^ipnet.Mask[i]
+	}
+	return ip, nil
+}
+
+// resolvePrefix picks a random address inside a prefix routed to this
+// host. The address is not assigned to any interface, so the socket is
+// bound with IP_FREEBIND and relies on a local route for the prefix.
+func (p *proxy) resolvePrefix(hint string, prefix string) (*source, error) {
+	_, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix: %w", err)
+	}
+	network := "tcp6"
+	if ip4 := ipnet.IP.To4(); ip4 != nil {
+		network = "tcp4"
+		ipnet.IP = ip4
+	}
+	if hint != "tcp" && hint != network {
+		return nil, fmt.Errorf("prefix %s does not match %s", prefix, hint)
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones < 2 {
+		return nil, errors.New("prefix is too small")
+	}
+
+	for {
+		ip, err := randomIP(ipnet)
+		if err != nil {
+			return nil, err
+		}
+		// Skip the subnet-router anycast (and, for IPv4, broadcast) address.
+		if ip.Equal(ipnet.IP.Mask(ipnet.Mask)) {
+			continue
+		}
+		if network == "tcp4" && ip.Equal(hostMax(ipnet)) {
+			continue
+		}
+		src := newSource(ip, network)
+		src.freebind = true
+		src.prefix = ipnet.String()
+		return src, nil
+	}
+}
+
+func hostMax(ipnet *net.IPNet) net.IP {
+	ip := make(net.IP, len(ipnet.IP))
+	for i := range ip {
+		ip[i] = ipnet.IP[i] | ^ipnet.Mask[i]
+	}
+	return ip
+}
@@ -0,0 +1,285 @@
+package maddrproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hrntknr/maddr-proxy/pkg/utils"
+)
+
+const poolPrefix = "pool"
+
+const (
+	strategyRandom     = "random"
+	strategyRoundRobin = "round-robin"
+	strategyLeastConn  = "least-conn"
+)
+
+type poolSpec struct {
+	match    []string
+	strategy string
+	session  string
+}
+
+// parsePoolSpec parses the part after "pool:", which is a comma separated
+// list of interface globs, CIDRs or "all", followed by ;key=value options.
+func parsePoolSpec(spec string, strategy string) (*poolSpec, error) {
+	parts := strings.Split(spec, ";")
+	ps := &poolSpec{strategy: strategy}
+	for _, m := range strings.Split(parts[0], ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			ps.match = append(ps.match, m)
+		}
+	}
+	if len(ps.match) == 0 {
+		return nil, errors.New("empty pool selector")
+	}
+	for _, opt := range parts[1:] {
+		key, value, _ := strings.Cut(opt, "=")
+		switch key {
+		case "strategy":
+			if err := validateStrategy(value); err != nil {
+				return nil, err
+			}
+			ps.strategy = value
+		case "session":
+			if value == "" {
+				return nil, errors.New("empty pool session")
+			}
+			ps.session = value
+		default:
+			return nil, fmt.Errorf("unknown pool option: %s", key)
+		}
+	}
+	return ps, nil
+}
+
+func validateStrategy(strategy string) error {
+	switch strategy {
+	case strategyRandom, strategyRoundRobin, strategyLeastConn:
+		return nil
+	default:
+		return fmt.Errorf("unknown pool strategy: %s", strategy)
+	}
+}
+
+func (ps *poolSpec) matches(iface string, ip net.IP) bool {
+	for _, m := range ps.match {
+		if m == "all" {
+			return true
+		}
+		if _, ipnet, err := net.ParseCIDR(m); err == nil {
+			if ipnet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(m, iface); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type sourceCandidate struct {
+	iface string
+	ip    net.IP
+}
+
+// candidates lists the valid addresses of the pool for one family, in a
+// stable order so that round-robin cycles through them predictably.
+func (ps *poolSpec) candidates(addrs *addrInventory, ipv6 bool, policy *egressPolicy) ([]sourceCandidate, error) {
+	ifaces, err := addrs.interfaces()
+	if err != nil {
+		return nil, err
+	}
+	ret := []sourceCandidate{}
+	for _, iface := range ifaces {
+		for _, ipnet := range iface.addrs {
+			if ipv6 && !utils.IsValidIPv6(ipnet.IP) || !ipv6 && !utils.IsValidIPv4(ipnet.IP) {
+				continue
+			}
+			if !ps.matches(iface.name, ipnet.IP) || !policy.allows(ipnet.IP, iface.name) {
+				continue
+			}
+			ret = append(ret, sourceCandidate{iface: iface.name, ip: ipnet.IP})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return bytes.Compare(ret[i].ip.To16(), ret[j].ip.To16()) < 0
+	})
+	return ret, nil
+}
+
+type sourcePool struct {
+	strategy string
+
+	mu    sync.Mutex
+	next  map[string]int
+	conns map[string]int
+}
+
+func newSourcePool(strategy string) *sourcePool {
+	return &sourcePool{
+		strategy: strategy,
+		next:     map[string]int{},
+		conns:    map[string]int{},
+	}
+}
+
+func (s *sourcePool) pick(key string, strategy string, candidates []sourceCandidate) sourceCandidate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch strategy {
+	case strategyRoundRobin:
+		i := s.next[key] % len(candidates)
+		s.next[key] = i + 1
+		return candidates[i]
+	case strategyLeastConn:
+		best := candidates[0]
+		for _, c := range candidates[1:] {
+			if s.conns[c.ip.String()] < s.conns[best.ip.String()] {
+				best = c
+			}
+		}
+		return best
+	default:
+		return candidates[rand.Intn(len(candidates))]
+	}
+}
+
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// track counts conn against its source address for least-conn selection
+// until it is closed.
+func (s *sourcePool) track(conn net.Conn, ip net.IP) net.Conn {
+	key := ip.String()
+	s.mu.Lock()
+	s.conns[key]++
+	s.mu.Unlock()
+	return &trackedConn{
+		Conn: conn,
+		release: func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.conns[key]--; s.conns[key] <= 0 {
+				delete(s.conns, key)
+			}
+		},
+	}
+}
+
+// poolSource returns ip as a source, with the rest of the pool following
+// it in order as fallbacks.
+func poolSource(ip net.IP, network string, candidates []sourceCandidate) *source {
+	src := newSource(ip, network)
+	for i, c := range candidates {
+		if !c.ip.Equal(ip) {
+			continue
+		}
+		src.iface = c.iface
+		for j := 1; j < len(candidates); j++ {
+			next := candidates[(i+j)%len(candidates)]
+			fallback := newSource(next.ip, network)
+			fallback.iface = next.iface
+			src.fallbacks = append(src.fallbacks, fallback)
+		}
+		break
+	}
+	return src
+}
+
+func (p *proxy) resolvePool(hint string, ps *poolSpec, target string, pr *principal) (*source, error) {
+	strategy := ps.strategy
+	if strategy == "" {
+		strategy = p.sources.strategy
+	}
+
+	// The target is resolved before picking, as each candidate would
+	// resolve it, which differs between interfaces with their own
+	// nameservers. Candidates whose resolution fails or lacks the family
+	// are passed over, so the pick never settles on an unusable address.
+	type resolution struct {
+		ips []net.IP
+		err error
+	}
+	resolved := map[string]*resolution{}
+	var lookupErr error
+	for _, family := range []struct {
+		ipv6    bool
+		network string
+		ok      bool
+	}{
+		{ipv6: true, network: "tcp6", ok: hint == "tcp6" || hint == "tcp"},
+		{ipv6: false, network: "tcp4", ok: hint == "tcp4" || hint == "tcp"},
+	} {
+		if !family.ok {
+			continue
+		}
+		candidates, err := ps.candidates(p.addrs, family.ipv6, pr.policy)
+		if err != nil {
+			return nil, err
+		}
+		usable := []sourceCandidate{}
+		scopes := map[string]string{}
+		for _, c := range p.health.filter(candidates) {
+			src := newSource(c.ip, family.network)
+			src.iface = c.iface
+			scope, _ := p.dnsDialer(src)
+			r, ok := resolved[scope]
+			if !ok {
+				r = &resolution{}
+				r.ips, r.err = p.resolveTarget(src, target)
+				resolved[scope] = r
+			}
+			if r.err != nil {
+				lookupErr = r.err
+				continue
+			}
+			if hasIPv4, hasIPv6 := ipFamilies(r.ips); family.ipv6 && !hasIPv6 || !family.ipv6 && !hasIPv4 {
+				continue
+			}
+			usable = append(usable, c)
+			scopes[c.ip.String()] = scope
+		}
+		if len(usable) == 0 {
+			continue
+		}
+
+		pool := strings.Join(ps.match, ",")
+		var ip net.IP
+		if ps.session != "" {
+			key := leaseKey{user: pr.name, network: family.network, pool: pool, session: ps.session}
+			ip = p.pickSession(key, strategy, usable)
+		} else {
+			ip = p.sources.pick(family.network+"/"+pool, strategy, usable).ip
+		}
+		src := poolSource(ip, family.network, usable)
+		src.targetIPs = resolved[scopes[ip.String()]].ips
+		for _, f := range src.fallbacks {
+			f.targetIPs = resolved[scopes[f.ip().String()]].ips
+		}
+		return src, nil
+	}
+	if lookupErr != nil {
+		return nil, lookupErr
+	}
+	return nil, errors.New("no suitable address found in pool")
+}
@@ -0,0 +1,88 @@
+package maddrproxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParsePoolSpec(t *testing.T) {
+	tt := []struct {
+		spec     string
+		match    []string
+		strategy string
+		err      bool
+	}{
+		{spec: "eth*", match: []string{"eth*"}, strategy: strategyRandom},
+		{spec: "all;strategy=round-robin", match: []string{"all"}, strategy: strategyRoundRobin},
+		{spec: "eth1,203.0.113.0/28;strategy=least-conn", match: []string{"eth1", "203.0.113.0/28"}, strategy: strategyLeastConn},
+		{spec: "eth*;strategy=unknown", err: true},
+		{spec: "eth*;unknown=1", err: true},
+		{spec: ";strategy=random", err: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.spec, func(t *testing.T) {
+			ps, err := parsePoolSpec(tc.spec, strategyRandom)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ps.match) != len(tc.match) || ps.strategy != tc.strategy {
+				t.Fatalf("unexpected spec %+v", ps)
+			}
+			for i := range tc.match {
+				if ps.match[i] != tc.match[i] {
+					t.Fatalf("unexpected spec %+v", ps)
+				}
+			}
+		})
+	}
+}
+
+func TestPoolSpecMatches(t *testing.T) {
+	ps, err := parsePoolSpec("eth*,203.0.113.0/28", strategyRandom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ps.matches("eth1", net.ParseIP("192.0.2.1")) {
+		t.Fatal("expected interface glob to match")
+	}
+	if !ps.matches("ens3", net.ParseIP("203.0.113.5")) {
+		t.Fatal("expected cidr to match")
+	}
+	if ps.matches("ens3", net.ParseIP("203.0.113.16")) {
+		t.Fatal("expected no match")
+	}
+}
+
+func TestSourcePoolPick(t *testing.T) {
+	candidates := []sourceCandidate{
+		{iface: "eth1", ip: net.ParseIP("192.0.2.1")},
+		{iface: "eth1", ip: net.ParseIP("192.0.2.2")},
+		{iface: "eth2", ip: net.ParseIP("192.0.2.3")},
+	}
+	s := newSourcePool(strategyRandom)
+
+	for i := 0; i < 6; i++ {
+		c := s.pick("key", strategyRoundRobin, candidates)
+		if !c.ip.Equal(candidates[i%3].ip) {
+			t.Fatalf("round-robin pick %d: expected %s, got %s", i, candidates[i%3].ip, c.ip)
+		}
+	}
+
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := s.track(a, candidates[0].ip)
+	s.track(b, candidates[1].ip)
+	if c := s.pick("key", strategyLeastConn, candidates); !c.ip.Equal(candidates[2].ip) {
+		t.Fatalf("least-conn: expected %s, got %s", candidates[2].ip, c.ip)
+	}
+	conn.Close()
+	if c := s.pick("key", strategyLeastConn, candidates); !c.ip.Equal(candidates[0].ip) {
+		t.Fatalf("least-conn: expected %s, got %s", candidates[0].ip, c.ip)
+	}
+}
@@ -0,0 +1,210 @@
+package maddrproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestResolvePrefix(t *testing.T) {
+	p := NewTestProxy(nil)
+	tt := []struct {
+		user    string
+		network string
+		prefix  string
+		err     bool
+	}{
+		{user: "tcp6:prefix:2001:db8:1::/64", network: "tcp6", prefix: "2001:db8:1::/64"},
+		{user: "prefix:2001:db8:1::/64", network: "tcp6", prefix: "2001:db8:1::/64"},
+		{user: "prefix:198.51.100.0/24", network: "tcp4", prefix: "198.51.100.0/24"},
+		{user: "tcp4:prefix:2001:db8:1::/64", err: true},
+		{user: "tcp6:prefix:2001:db8:1::/128", err: true},
+		{user: "prefix:invalid", err: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.user, func(t *testing.T) {
+			src, err := p.resolve("example.com:80", &principal{user: tc.user})
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, ipnet, _ := net.ParseCIDR(tc.prefix)
+			if src.network != tc.network || !src.freebind || !ipnet.Contains(src.ip()) {
+				t.Fatalf("unexpected source %s %s", src.network, src.addr)
+			}
+			if src.ip().Equal(ipnet.IP) {
+				t.Fatalf("unexpected subnet-router address %s", src.addr)
+			}
+		})
+	}
+}
+
+func TestBindDevice(t *testing.T) {
+	lo, err := loopbackInterface()
+	if err != nil {
+		t.Skip(err)
+	}
+	dummyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer dummyServer.Close()
+
+	p := NewTestProxy(nil)
+	client := NewProxyClient(p, func(u *url.URL) { u.User = url.User("tcp4:" + lo) })
+	if resp, err := client.Get(dummyServer.URL); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode == http.StatusOK {
+		t.Fatal("expected an error without a usable address")
+	}
+
+	p.SetBindDevice(true)
+	src, err := p.resolve(dummyServer.Listener.Addr().String(), &principal{user: "tcp4:" + lo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.device != lo || src.network != "tcp4" {
+		t.Fatalf("unexpected source %s %s %s", src.network, src.addr, src.device)
+	}
+	resp, err := client.Get(dummyServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func loopbackInterface() (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			return iface.Name, nil
+		}
+	}
+	return "", errors.New("no loopback interface")
+}
+
+func TestResolveMark(t *testing.T) {
+	p := NewTestProxy(nil)
+	if err := p.SetMarks([]string{"isp1=0x10", "isp2=32"}); err != nil {
+		t.Fatal(err)
+	}
+	tt := []struct {
+		user    string
+		network string
+		mark    uint32
+		err     bool
+	}{
+		{user: "mark:isp1", network: "tcp", mark: 0x10},
+		{user: "tcp6:mark:isp2", network: "tcp6", mark: 32},
+		{user: "tcp4:mark:0x20", network: "tcp4", mark: 0x20},
+		{user: "mark:isp3", err: true},
+		{user: "mark:0", err: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.user, func(t *testing.T) {
+			src, err := p.resolve("example.com:80", &principal{user: tc.user})
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if src.network != tc.network || src.mark != tc.mark {
+				t.Fatalf("unexpected source %s %d", src.network, src.mark)
+			}
+		})
+	}
+
+	policy, err := parseEgressPolicy([]string{"mark:isp1", "mark:0x20"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		src     *source
+		allowed bool
+	}{
+		{src: &source{mark: 0x10, markName: "isp1"}, allowed: true},
+		{src: &source{mark: 0x20, markName: "isp2"}, allowed: true},
+		{src: &source{mark: 0x30, markName: "0x30"}, allowed: false},
+	} {
+		if err := policy.check(tc.src, nil); (err == nil) != tc.allowed {
+			t.Fatalf("mark %s: unexpected result %v", tc.src.markName, err)
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// 192.0.2.1 is not assigned to the host, so binding to it fails.
+	newFailingSource := func() *source {
+		src := newSource(net.ParseIP("192.0.2.1").To4(), "tcp4")
+		src.fallbacks = []*source{newSource(net.ParseIP("127.0.0.1").To4(), "tcp4")}
+		return src
+	}
+
+	p := NewTestProxy(nil)
+	if _, _, err := p.dialFailover(context.Background(), newFailingSource(), ln.Addr().String(), &principal{}); err == nil {
+		t.Fatal("expected error without failover")
+	}
+
+	p.SetFailover(1)
+	conn, used, err := p.dialFailover(context.Background(), newFailingSource(), ln.Addr().String(), &principal{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if used.String() != "127.0.0.1" {
+		t.Fatalf("expected failover to 127.0.0.1, got %s", used)
+	}
+
+	policy, err := parseEgressPolicy([]string{"192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := p.dialFailover(context.Background(), newFailingSource(), ln.Addr().String(), &principal{policy: policy}); err == nil {
+		t.Fatal("expected no failover to a denied source")
+	}
+}
+
+func TestPoolSource(t *testing.T) {
+	candidates := []sourceCandidate{
+		{ip: net.ParseIP("192.0.2.1")},
+		{ip: net.ParseIP("192.0.2.2")},
+		{ip: net.ParseIP("192.0.2.3")},
+	}
+	src := poolSource(net.ParseIP("192.0.2.2"), "tcp4", candidates)
+	if len(src.fallbacks) != 2 || src.fallbacks[0].String() != "192.0.2.3" || src.fallbacks[1].String() != "192.0.2.1" {
+		t.Fatalf("unexpected fallbacks %v", src.fallbacks)
+	}
+}
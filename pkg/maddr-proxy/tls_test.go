@@ -0,0 +1,188 @@
+package maddrproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTLSProxy(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert := func(cn string, mod time.Time) {
+		cert, err := NewTestCert(&x509.Certificate{
+			Subject:     pkix.Name{CommonName: cn},
+			IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cert.WriteFiles(certFile, keyFile); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(certFile, mod, mod)
+		os.Chtimes(keyFile, mod, mod)
+	}
+	writeCert("first", time.Now().Add(-time.Minute))
+
+	server, err := NewTestProxy([]string{}).newTLSServer("", certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(ln, "", "")
+	defer server.Close()
+
+	peerCN := func() string {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	if cn := peerCN(); cn != "first" {
+		t.Fatalf("expected certificate %q, got %q", "first", cn)
+	}
+	writeCert("second", time.Now())
+	if cn := peerCN(); cn != "second" {
+		t.Fatalf("expected reloaded certificate %q, got %q", "second", cn)
+	}
+
+	dummyServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer dummyServer.Close()
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(&url.URL{Scheme: "https", Host: ln.Addr().String()}),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	resp, err := client.Get(dummyServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestMutualTLSProxy(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := NewTestCert(&x509.Certificate{Subject: pkix.Name{CommonName: "ca"}, IsCA: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ca.WriteFiles(caFile, filepath.Join(dir, "ca-key.pem")); err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewTestCert(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "proxy"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	}, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := server.WriteFiles(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewTestProxy([]string{"password"})
+	if err := p.SetClientCA(caFile, []string{"crawler.example.com=127.0.0.0/8", "*=127.0.0.2/32"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ListenAndServe("127.0.0.1:0"); err != errClientCANeedsTLS {
+		t.Fatalf("expected %v from the plain listener, got %v", errClientCANeedsTLS, err)
+	}
+	if err := p.ListenAndServeSocks("127.0.0.1:0"); err != errClientCANeedsTLS {
+		t.Fatalf("expected %v from the socks listener, got %v", errClientCANeedsTLS, err)
+	}
+	proxyServer, err := p.newTLSServer("", certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxyServer.ServeTLS(ln, "", "")
+	defer proxyServer.Close()
+
+	dummyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer dummyServer.Close()
+
+	tt := []struct {
+		name     string
+		dnsName  string
+		user     *url.Userinfo
+		expected int
+	}{
+		{
+			name:     "allowed address",
+			dnsName:  "crawler.example.com",
+			user:     url.User("127.0.0.1"),
+			expected: http.StatusOK,
+		},
+		{
+			name:     "unselected address",
+			dnsName:  "crawler.example.com",
+			expected: http.StatusForbidden,
+		},
+		{
+			name:     "unknown identity",
+			dnsName:  "other.example.com",
+			user:     url.User("127.0.0.1"),
+			expected: http.StatusForbidden,
+		},
+		{
+			name:     "default policy",
+			dnsName:  "other.example.com",
+			user:     url.User("127.0.0.2"),
+			expected: http.StatusOK,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := NewTestCert(&x509.Certificate{DNSNames: []string{tc.dnsName}}, ca)
+			if err != nil {
+				t.Fatal(err)
+			}
+			roots := x509.NewCertPool()
+			roots.AddCert(ca.Cert)
+			httpClient := &http.Client{
+				Transport: &http.Transport{
+					Proxy: http.ProxyURL(&url.URL{Scheme: "https", Host: ln.Addr().String(), User: tc.user}),
+					TLSClientConfig: &tls.Config{
+						RootCAs:      roots,
+						Certificates: []tls.Certificate{client.TLSCertificate()},
+					},
+				},
+			}
+			resp, err := httpClient.Get(dummyServer.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.expected {
+				t.Fatalf("expected status %d, got %d", tc.expected, resp.StatusCode)
+			}
+		})
+	}
+}
@@ -1,12 +1,36 @@
 package maddrproxy
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"strconv"
+	"time"
 )
 
+// NewTestProxy returns a proxy allowed to reach the loopback test servers.
+func NewTestProxy(passwords []string) *proxy {
+	p := NewProxy(passwords)
+	if err := p.SetDestinationRules([]string{"allow 127.0.0.0/8"}, true); err != nil {
+		panic(err)
+	}
+	return p
+}
+
 func NewProxyClient(p *proxy, proxyUrlModifyFunc func(*url.URL)) *http.Client {
 	proxyInstance := httptest.NewServer(http.HandlerFunc(p.serve))
 	return &http.Client{
@@ -25,3 +49,166 @@ func NewProxyClient(p *proxy, proxyUrlModifyFunc func(*url.URL)) *http.Client {
 		},
 	}
 }
+
+func NewSocksListener(p *proxy) (net.Listener, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serveSocks(conn)
+		}
+	}()
+	return ln, nil
+}
+
+func SocksHandshake(conn net.Conn, user *url.Userinfo) error {
+	if user == nil {
+		if _, err := conn.Write([]byte{socksVersion, 1, socksAuthNone}); err != nil {
+			return err
+		}
+	} else {
+		if _, err := conn.Write([]byte{socksVersion, 1, socksAuthPassword}); err != nil {
+			return err
+		}
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	switch resp[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		password, _ := user.Password()
+		b := []byte{socksAuthPasswordVersion, byte(len(user.Username()))}
+		b = append(b, user.Username()...)
+		b = append(b, byte(len(password)))
+		b = append(b, password...)
+		if _, err := conn.Write(b); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return err
+		}
+		if resp[1] != 0x00 {
+			return errors.New("authentication failed")
+		}
+	default:
+		return errors.New("no acceptable authentication method")
+	}
+	return nil
+}
+
+func SocksRequest(conn net.Conn, cmd byte, target string) (net.Addr, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	b := []byte{socksVersion, cmd, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		b = appendSocksAddr(b, &net.TCPAddr{IP: ip, Port: port})
+	} else {
+		b = append(b, socksAtypDomain, byte(len(host)))
+		b = append(b, host...)
+		b = binary.BigEndian.AppendUint16(b, uint16(port))
+	}
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 3)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	bound, err := readSocksAddr(conn)
+	if err != nil {
+		return nil, err
+	}
+	if resp[1] != socksRepSucceeded {
+		return nil, fmt.Errorf("socks reply: %d", resp[1])
+	}
+	return net.ResolveTCPAddr("tcp", bound)
+}
+
+func NewSocksClient(proxyAddr string, user *url.Userinfo) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := net.Dial("tcp", proxyAddr)
+				if err != nil {
+					return nil, err
+				}
+				if err := SocksHandshake(conn, user); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				if _, err := SocksRequest(conn, socksCmdConnect, addr); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return conn, nil
+			},
+		},
+	}
+}
+
+type TestCert struct {
+	Cert *x509.Certificate
+	Key  *ecdsa.PrivateKey
+}
+
+func NewTestCert(template *x509.Certificate, parent *TestCert) (*TestCert, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if template.IsCA {
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.Cert, parent.Key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &TestCert{Cert: cert, Key: key}, nil
+}
+
+func (c *TestCert) TLSCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.Cert.Raw}, PrivateKey: c.Key, Leaf: c.Cert}
+}
+
+func (c *TestCert) WriteFiles(certFile string, keyFile string) error {
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Cert.Raw}), 0600); err != nil {
+		return err
+	}
+	der, err := x509.MarshalECPrivateKey(c.Key)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against when the user does not exist, so that
+// unknown and known users take the same time to reject.
+var dummyHash = []byte("$2a$10$hhnGGJGUOIq6qTKT1F/ItOuT2aDlcnNvMoE6lZgUeR1oYYsQnW2x6")
+
+type Htpasswd struct {
+	path string
+
+	mu    sync.RWMutex
+	users map[string]string
+	mod   time.Time
+}
+
+func NewHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{
+		path: path,
+	}
+	if err := h.reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *Htpasswd) reload() error {
+	stat, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+	h.mu.RLock()
+	unchanged := h.users != nil && stat.ModTime().Equal(h.mod)
+	h.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	users := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.Index(text, ":")
+		if i == -1 {
+			return fmt.Errorf("%s:%d: invalid entry", h.path, line)
+		}
+		users[text[:i]] = text[i+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.users, h.mod = users, stat.ModTime()
+	h.mu.Unlock()
+	return nil
+}
+
+func (h *Htpasswd) Verify(user string, password string) bool {
+	// Keep the last good file if it is missing or broken mid-update.
+	h.reload()
+
+	name, _ := SplitUser(user)
+	h.mu.RLock()
+	hash, ok := h.users[name]
+	h.mu.RUnlock()
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return verifyHash(hash, password)
+}
+
+func verifyHash(hash string, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$argon2id$"), strings.HasPrefix(hash, "$argon2i$"):
+		return verifyArgon2(hash, password)
+	default:
+		return false
+	}
+}
+
+// verifyArgon2 checks a PHC formatted hash such as
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>.
+func verifyArgon2(hash string, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	var memory, iterations uint32
+	var parallelism uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &parallelism); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+
+	var derived []byte
+	switch parts[1] {
+	case "argon2id":
+		derived = argon2.IDKey([]byte(password), salt, iterations, memory, parallelism, uint32(len(key)))
+	case "argon2i":
+		derived = argon2.Key([]byte(password), salt, iterations, memory, parallelism, uint32(len(key)))
+	}
+	return subtle.ConstantTimeCompare(derived, key) == 1
+}
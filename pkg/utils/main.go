@@ -3,16 +3,18 @@ package utils
 import (
 	"bufio"
 	"context"
+	"crypto/subtle"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"strings"
+	"syscall"
 	"time"
 )
 
-func getAuth(proxyAuthHeaderKey string, r *http.Request) (string, string, error) {
+func GetAuth(proxyAuthHeaderKey string, r *http.Request) (string, string, error) {
 	authHeader := r.Header.Get(proxyAuthHeaderKey)
 	if authHeader == "" {
 		return "", "", nil
@@ -31,26 +33,77 @@ func getAuth(proxyAuthHeaderKey string, r *http.Request) (string, string, error)
 	return user, password, nil
 }
 
-func ProxyAuthenticate(proxyAuthHeaderKey string, passwords []string, r *http.Request) (string, int, error) {
-	user, password, err := getAuth(proxyAuthHeaderKey, r)
+type Verifier interface {
+	Verify(user string, password string) bool
+}
+
+type Passwords []string
+
+func (p Passwords) Verify(user string, password string) bool {
+	ok := 0
+	for _, pw := range p {
+		ok |= subtle.ConstantTimeCompare([]byte(pw), []byte(password))
+	}
+	return ok == 1
+}
+
+// SplitUser separates the identity from the source address selector in
+// user names of the form identity+selector.
+func SplitUser(user string) (string, string) {
+	if i := strings.Index(user, "+"); i != -1 {
+		return user[:i], user[i+1:]
+	}
+	return user, ""
+}
+
+func ProxyAuthenticate(proxyAuthHeaderKey string, verifier Verifier, r *http.Request) (string, int, error) {
+	user, password, err := GetAuth(proxyAuthHeaderKey, r)
 	if err != nil {
 		return "", http.StatusProxyAuthRequired, err
 	}
 
-	if len(passwords) == 0 {
-		return user, http.StatusOK, nil
+	if code, err := Authenticate(verifier, user, password); err != nil {
+		return "", code, err
+	}
+	return user, http.StatusOK, nil
+}
+
+func Authenticate(verifier Verifier, user string, password string) (int, error) {
+	if verifier == nil {
+		return http.StatusOK, nil
 	}
 	if password == "" {
-		return "", http.StatusProxyAuthRequired, errors.New(http.StatusText(http.StatusProxyAuthRequired))
+		return http.StatusProxyAuthRequired, errors.New(http.StatusText(http.StatusProxyAuthRequired))
+	}
+	if !verifier.Verify(user, password) {
+		return http.StatusForbidden, errors.New(http.StatusText(http.StatusForbidden))
 	}
+	return http.StatusOK, nil
+}
+
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
 
-	for _, p := range passwords {
-		if p == password {
-			return user, http.StatusOK, nil
+func RemoveHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				h.Del(f)
+			}
 		}
 	}
-
-	return "", http.StatusForbidden, errors.New(http.StatusText(http.StatusForbidden))
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
 }
 
 func WriteHttpResponseConn(conn net.Conn, status int, msg string, headers http.Header) error {
@@ -96,13 +149,54 @@ func WriteHttpResponse(wr *bufio.ReadWriter, status int, msg string, headers htt
 	return nil
 }
 
-func GetDialContext(timeout time.Duration, localAddr net.Addr) func(context.Context, string, string) (net.Conn, error) {
+func WriteHttpError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("X-Proxy-Error", err.Error())
+	w.WriteHeader(status)
+}
+
+// SocketOption is applied to a socket after it is created and before it
+// is bound or connected.
+type SocketOption func(network string, fd int) error
+
+func Control(opts ...SocketOption) func(string, string, syscall.RawConn) error {
+	if len(opts) == 0 {
+		return nil
+	}
+	return func(network string, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			for _, opt := range opts {
+				if err = opt(network, int(fd)); err != nil {
+					return
+				}
+			}
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+func GetDialContext(timeout time.Duration, localAddr net.Addr, opts ...SocketOption) func(context.Context, string, string) (net.Conn, error) {
 	return (&net.Dialer{
 		Timeout:   timeout,
 		LocalAddr: localAddr,
+		Control:   Control(opts...),
 	}).DialContext
 }
 
+func ListenPacket(network string, localAddr *net.UDPAddr, opts ...SocketOption) (*net.UDPConn, error) {
+	address := ""
+	if localAddr != nil {
+		address = localAddr.String()
+	}
+	conn, err := (&net.ListenConfig{Control: Control(opts...)}).ListenPacket(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
 func IsValidIPv4(ip net.IP) bool {
 	if ip.To4() == nil {
 		return false
@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"runtime"
+
+	"github.com/vishvananda/netns"
+)
+
+// InNetns runs fn on an OS thread switched into the network namespace ns,
+// so that sockets created by fn belong to that namespace.
+func InNetns(ns netns.NsHandle, fn func() error) error {
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer origin.Close()
+	if err := netns.Set(ns); err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	fnErr := fn()
+	if err := netns.Set(origin); err != nil {
+		// The thread is left locked so that the runtime discards it
+		// instead of reusing it in the wrong namespace.
+		return err
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
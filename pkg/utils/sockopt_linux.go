@@ -0,0 +1,34 @@
+//go:build linux
+
+package utils
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+func isIPv6Network(network string) bool {
+	return strings.HasSuffix(network, "6")
+}
+
+func Freebind() SocketOption {
+	return func(network string, fd int) error {
+		if isIPv6Network(network) {
+			return unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_FREEBIND, 1)
+		}
+		return unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_FREEBIND, 1)
+	}
+}
+
+func BindToDevice(device string) SocketOption {
+	return func(network string, fd int) error {
+		return unix.BindToDevice(fd, device)
+	}
+}
+
+func Mark(mark uint32) SocketOption {
+	return func(network string, fd int) error {
+		return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, int(mark))
+	}
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+
+package utils
+
+import (
+	"errors"
+)
+
+var errSocketOptionNotSupported = errors.New("socket option is not supported on this platform")
+
+func Freebind() SocketOption {
+	return func(network string, fd int) error {
+		return errSocketOptionNotSupported
+	}
+}
+
+func BindToDevice(device string) SocketOption {
+	return func(network string, fd int) error {
+		return errSocketOptionNotSupported
+	}
+}
+
+func Mark(mark uint32) SocketOption {
+	return func(network string, fd int) error {
+		return errSocketOptionNotSupported
+	}
+}